@@ -1,20 +1,55 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"os"
+	"trees/pkg/btree/comparator"
+	"trees/pkg/btree/kvstore"
 )
 
+const usage = `usage: %s <command> [arguments]
+
+commands:
+  compact [-comparator name] [-wal] <file>   rewrite a database file into a minimal file
+`
+
 func main() {
-	a := []int(nil)
-	for i := range a {
-		fmt.Println(i)
+	if len(os.Args) < 2 {
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "compact":
+		compact(os.Args[2:])
+	default:
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		os.Exit(2)
 	}
-	fmt.Println(len(a))
+}
 
+func compact(args []string) {
+	flags := flag.NewFlagSet("compact", flag.ExitOnError)
+	name := flags.String("comparator", comparator.Bytewise.Name, "the comparator the file was created with")
+	wal := flags.Bool("wal", false, "replay the write-ahead log of a file last used in WAL mode")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	cmp, ok := comparator.ByName(*name)
+	if !ok {
+		exitOnError(fmt.Errorf("unknown comparator %q", *name))
+	}
+	path := flags.Arg(0)
+	stats, err := kvstore.Compact(path, kvstore.Options{Comparator: cmp, WAL: *wal})
+	exitOnError(err)
+	fmt.Printf("%s: %d bytes before, %d bytes after\n", path, stats.SizeBefore, stats.SizeAfter)
 }
 
-func panicOnError(err error) {
+func exitOnError(err error) {
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 }
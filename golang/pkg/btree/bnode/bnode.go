@@ -4,11 +4,21 @@ import (
 	"bytes"
 	"encoding/binary"
 	"trees/internal/errors"
+	"trees/pkg/btree/comparator"
 	"trees/pkg/btree/constant"
 	"trees/pkg/btree/types"
 )
 
-type BNode []byte // can be dumped to the disk
+// BNode is a node of the tree, it can be dumped to the disk.
+// | type | nkeys |  pointers  |   offsets  | key-values | unused |
+// |  2B  |   2B  | nkeys * 8B | nkeys * 4B |    ...     |        |
+// a key-value is
+// | klen | vlen | key | val |
+// |  2B  |  2B  | ... | ... |
+// a node is at most one page, except the temporary results of an update
+// which can be bigger and get split by Split3.
+// nodes can also use the prefix compression layout, see BNODE_PREFIX.
+type BNode []byte
 
 const (
 	BNODE_NODE = 1 // internal nodes without values
@@ -16,7 +26,7 @@ const (
 )
 
 func (node BNode) Type() uint16 {
-	return binary.LittleEndian.Uint16(node[0:2])
+	return binary.LittleEndian.Uint16(node[0:2]) &^ BNODE_PREFIX
 }
 func (node BNode) NumKeys() uint16 {
 	return binary.LittleEndian.Uint16(node[2:4])
@@ -29,96 +39,108 @@ func (node BNode) SetHeader(btype uint16, nkeys uint16) {
 // pointers
 func (node BNode) GetPtr(idx uint16) types.PagePtr {
 	errors.Assert(idx < node.NumKeys(), "idx < node.nkeys()")
-	pos := constant.HEADER_SIZE + 8*idx
+	pos := node.hdrSize() + 8*uint32(idx)
 	return types.PagePtr(binary.LittleEndian.Uint64(node[pos:]))
 }
 func (node BNode) SetPtr(idx uint16, val types.PagePtr) {
 	errors.Assert(idx < node.NumKeys(), "idx < node.nkeys()")
-	pos := constant.HEADER_SIZE + 8*idx
+	pos := node.hdrSize() + 8*uint32(idx)
 	binary.LittleEndian.PutUint64(node[pos:], uint64(val))
 }
 
 // offset list
-func offsetPos(node BNode, idx uint16) uint16 {
+// offsets are 4 bytes so that nodes bigger than 64KB can be addressed,
+// which is the case of oversized nodes with large page sizes
+func offsetPos(node BNode, idx uint16) uint32 {
 	errors.Assert(1 <= idx && idx <= node.NumKeys(), "1 <= idx && idx <= node.nkeys()")
-	return constant.HEADER_SIZE + 8*node.NumKeys() + 2*(idx-1)
+	return node.hdrSize() + 8*uint32(node.NumKeys()) + 4*uint32(idx-1)
 }
-func (node BNode) GetOffset(idx uint16) uint16 {
+func (node BNode) GetOffset(idx uint16) uint32 {
 	if idx == 0 {
 		return 0
 	}
-	return binary.LittleEndian.Uint16(node[offsetPos(node, idx):])
+	return binary.LittleEndian.Uint32(node[offsetPos(node, idx):])
 }
-func (node BNode) SetOffset(idx uint16, offset uint16) {
+func (node BNode) SetOffset(idx uint16, offset uint32) {
 	if idx == 0 {
 		return
 	}
-	binary.LittleEndian.PutUint16(node[offsetPos(node, idx):], offset)
+	binary.LittleEndian.PutUint32(node[offsetPos(node, idx):], offset)
 }
 
 // key-values
-func (node BNode) kvPos(idx uint16) uint16 {
+func (node BNode) kvPos(idx uint16) uint32 {
 	errors.Assert(idx <= node.NumKeys(), "idx <= node.nkeys()")
-	return constant.HEADER_SIZE + 8*node.NumKeys() + 2*node.NumKeys() + node.GetOffset(idx)
+	return node.hdrSize() + 8*uint32(node.NumKeys()) + 4*uint32(node.NumKeys()) + node.GetOffset(idx)
 }
+
+// GetKey returns the key at index idx.
+// with the prefix compression layout, the key is rebuilt into a new slice.
 func (node BNode) GetKey(idx uint16) []byte {
+	suffix := node.keySuffix(idx)
+	if !node.hasPrefix() {
+		return suffix
+	}
+	prefix := node.Prefix()
+	key := make([]byte, 0, len(prefix)+len(suffix))
+	return append(append(key, prefix...), suffix...)
+}
+
+// keySuffix returns the key at index idx as stored in the node, without the node prefix
+func (node BNode) keySuffix(idx uint16) []byte {
 	errors.Assert(idx < node.NumKeys(), "idx < node.nkeys()")
 	pos := node.kvPos(idx)
-	klen := binary.LittleEndian.Uint16(node[pos:])
+	klen := uint32(binary.LittleEndian.Uint16(node[pos:]))
 	return node[pos+4 : pos+4+klen]
 }
 func (node BNode) GetVal(idx uint16) []byte {
 	errors.Assert(idx < node.NumKeys(), "idx < node.nkeys()")
 	pos := node.kvPos(idx)
-	klen := binary.LittleEndian.Uint16(node[pos:])
-	vlen := binary.LittleEndian.Uint16(node[pos+2:])
+	klen := uint32(binary.LittleEndian.Uint16(node[pos:]))
+	vlen := uint32(binary.LittleEndian.Uint16(node[pos+2:]))
 	return node[pos+4+klen : pos+4+klen+vlen]
 }
 
 // node size in bytes
-func (node BNode) NumBytes() uint16 {
+func (node BNode) NumBytes() uint32 {
 	return node.kvPos(node.NumKeys())
 }
 
 // returns the first kid node whose range intersects the key. (kid[i] <= key)
-// TODO: binary search
-func (node BNode) LookupLE(key []byte) uint16 {
-	nkeys := node.NumKeys()
-	found := uint16(0)
+func (node BNode) LookupLE(key []byte, cmp *comparator.Comparator) uint16 {
 	// the first key is a copy from the parent node,
 	// thus it's always less than or equal to the key.
-	for i := uint16(1); i < nkeys; i++ {
-		cmp := bytes.Compare(node.GetKey(i), key)
-		if cmp <= 0 {
-			found = i
-		}
-		if cmp >= 0 {
-			break
+	// binary search for the first key that is greater than the key in [1, nkeys)
+	lo, hi := uint16(1), node.NumKeys()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if node.CompareKey(mid, key, cmp) <= 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
 		}
 	}
-	return found
+	return lo - 1
 }
 
 // LeafUpdate copies old into new
 // and updates new's key/value at index idx
-// new should be 2*BTREE_PAGE_SIZE, in case the new key/value is too big
+// new should be 2 pages, in case the new key/value is too big
 // and overflows, and hence the caller should split the node.
 func LeafUpdate(
 	new BNode, old BNode, idx uint16, key []byte, val []byte,
 ) {
 	new.SetHeader(BNODE_LEAF, old.NumKeys())
-	copy(new, old)
-	kvPos := new.kvPos(idx)
-	binary.LittleEndian.PutUint16(new[kvPos:], uint16(len(key)))
-	binary.LittleEndian.PutUint16(new[kvPos+2:], uint16(len(val)))
-	copy(new[kvPos+4:], key)
-	copy(new[kvPos+4+uint16(len(key)):], val)
+	new.CopyPtrsAndKVs(old, 0, 0, idx)
+	// the new value can have a different size, so the following KVs are shifted
+	new.CopyPtrAndKV(idx, 0, key, val)
+	new.CopyPtrsAndKVs(old, idx+1, idx+1, old.NumKeys()-(idx+1))
 }
 
 // LeafInsert copies old into new
 // and inserts a new key to a new, at index idx
 // it doesn't overwrite, but will instead shift the other key/value pairs
-// new should be 2*BTREE_PAGE_SIZE, in case the new key/value is too big
+// new should be 2 pages, in case the new key/value is too big
 // and overflows, and hence the caller should split the node.
 func LeafInsert(
 	new BNode, old BNode, idx uint16, key []byte, val []byte,
@@ -131,8 +153,13 @@ func LeafInsert(
 
 // copy a ptr and KV into node at index idx, overwriting any existing data
 // ptr can be set to 0 when copying into a leaf node, and val can be set to nil when writing to a node.
+// with the prefix compression layout, the key must start with the node prefix, and only its suffix is stored.
 // TODO: given that there are 1 more ptr than key, what if we ever need to store a new ptr at the last position (that doesnt have an index?)?
 func (n BNode) CopyPtrAndKV(idx uint16, ptr types.PagePtr, key []byte, val []byte) {
+	if n.hasPrefix() {
+		errors.Assert(bytes.HasPrefix(key, n.Prefix()), "key doesn't start with the node prefix")
+		key = key[len(n.Prefix()):]
+	}
 	// ptrs
 	n.SetPtr(idx, ptr)
 	// KVs
@@ -140,9 +167,9 @@ func (n BNode) CopyPtrAndKV(idx uint16, ptr types.PagePtr, key []byte, val []byt
 	binary.LittleEndian.PutUint16(n[pos+0:], uint16(len(key)))
 	binary.LittleEndian.PutUint16(n[pos+2:], uint16(len(val)))
 	copy(n[pos+4:], key)
-	copy(n[pos+4+uint16(len(key)):], val)
+	copy(n[pos+4+uint32(len(key)):], val)
 	// the offset of the next key
-	n.SetOffset(idx+1, n.GetOffset(idx)+4+uint16((len(key)+len(val))))
+	n.SetOffset(idx+1, n.GetOffset(idx)+4+uint32((len(key)+len(val))))
 }
 
 // CopyPtrsAndKVs copies n ptrs and KVs from src BNode starting at index srcIdx, to dst BNode starting at index dstIdx
@@ -155,27 +182,54 @@ func (dst BNode) CopyPtrsAndKVs(
 	}
 }
 
-// split a oversized node into 2 so that the 2nd node always fits on a page
-func nodeSplit2(left BNode, right BNode, old BNode) {
-	// code omitted...
+// find where to split the KVs [begin, end) of an oversized node into 2 nodes,
+// so that the 2nd node [mid, end) always fits on a page.
+// the 1st node [begin, mid) might still be too big, in which case the caller should split it again.
+func (old BNode) nodeSplit2(begin uint16, end uint16, pageSize int, compress bool) uint16 {
+	errors.Assert(end-begin >= 2, "end-begin >= 2")
+	capacity := uint32(constant.NodeCapacity(pageSize))
+	// the initial guess
+	mid := begin + (end-begin)/2
+	// try to fit the left half
+	for old.rangeBytes(begin, mid, compress) > capacity {
+		mid--
+	}
+	errors.Assert(mid > begin, "mid > begin")
+	// try to fit the right half
+	for old.rangeBytes(mid, end, compress) > capacity {
+		mid++
+	}
+	errors.Assert(mid < end, "mid < end")
+	// NOTE: the left half may be still too big
+	return mid
 }
 
-// split a node if it's too big. the results are 1~3 nodes.
-func (old BNode) Split3() (uint16, [3]BNode) {
-	if old.NumBytes() <= constant.BTREE_PAGE_SIZE {
-		old = old[:constant.BTREE_PAGE_SIZE]
-		return 1, [3]BNode{old} // not split
+// split a node if it's too big to fit in a page. the results are 1~3 nodes.
+// with compress, the resulting nodes use the prefix compression layout when it saves space,
+// and their compressed size is what must fit in a page.
+func (old BNode) Split3(pageSize int, compress bool) (uint16, [3]BNode) {
+	nkeys := old.NumKeys()
+	capacity := uint32(constant.NodeCapacity(pageSize))
+	if old.rangeBytes(0, nkeys, compress) <= capacity {
+		return 1, [3]BNode{old.copyRange(0, nkeys, pageSize, compress)} // not split
 	}
-	left := BNode(make([]byte, 2*constant.BTREE_PAGE_SIZE)) // might be split later
-	right := BNode(make([]byte, constant.BTREE_PAGE_SIZE))
-	nodeSplit2(left, right, old)
-	if left.NumBytes() <= constant.BTREE_PAGE_SIZE {
-		left = left[:constant.BTREE_PAGE_SIZE]
+	mid := old.nodeSplit2(0, nkeys, pageSize, compress)
+	right := old.copyRange(mid, nkeys, pageSize, compress)
+	if old.rangeBytes(0, mid, compress) <= capacity {
+		left := old.copyRange(0, mid, pageSize, compress)
 		return 2, [3]BNode{left, right} // 2 nodes
 	}
-	leftleft := BNode(make([]byte, constant.BTREE_PAGE_SIZE))
-	middle := BNode(make([]byte, constant.BTREE_PAGE_SIZE))
-	nodeSplit2(leftleft, middle, left)
-	errors.Assert(leftleft.NumBytes() <= constant.BTREE_PAGE_SIZE, "leftleft.nbytes() <= BTREE_PAGE_SIZE")
+	leftMid := old.nodeSplit2(0, mid, pageSize, compress)
+	errors.Assert(old.rangeBytes(0, leftMid, compress) <= capacity, "leftleft.nbytes() <= capacity")
+	leftleft := old.copyRange(0, leftMid, pageSize, compress)
+	middle := old.copyRange(leftMid, mid, pageSize, compress)
 	return 3, [3]BNode{leftleft, middle, right} // 3 nodes
 }
+
+// Fit copies a node that fits in a page into a page,
+// using the prefix compression layout if compress is set and it saves space.
+func (node BNode) Fit(pageSize int, compress bool) BNode {
+	nkeys := node.NumKeys()
+	errors.Assert(node.rangeBytes(0, nkeys, compress) <= uint32(constant.NodeCapacity(pageSize)), "node doesn't fit in a page")
+	return node.copyRange(0, nkeys, pageSize, compress)
+}
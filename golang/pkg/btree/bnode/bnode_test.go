@@ -0,0 +1,274 @@
+package bnode
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+	"trees/pkg/btree/comparator"
+	"trees/pkg/btree/constant"
+
+	"github.com/stretchr/testify/require"
+)
+
+type kv struct {
+	key []byte
+	val []byte
+}
+
+var pageSizes = []int{constant.MIN_PAGE_SIZE, 16384, constant.MAX_PAGE_SIZE}
+
+// lookupLELinear is the linear scan version of LookupLE,
+// kept as a reference for tests and benchmarks.
+func (node BNode) lookupLELinear(key []byte, cmp *comparator.Comparator) uint16 {
+	nkeys := node.NumKeys()
+	found := uint16(0)
+	// the first key is a copy from the parent node,
+	// thus it's always less than or equal to the key.
+	for i := uint16(1); i < nkeys; i++ {
+		c := cmp.Compare(node.GetKey(i), key)
+		if c <= 0 {
+			found = i
+		}
+		if c >= 0 {
+			break
+		}
+	}
+	return found
+}
+
+// makeLeaf builds an (possibly oversized) leaf node holding the kvs
+func makeLeaf(pageSize int, kvs []kv) BNode {
+	size := constant.HEADER_SIZE
+	for _, kv := range kvs {
+		size += constant.ENTRY_OVERHEAD + len(kv.key) + len(kv.val)
+	}
+	node := BNode(make([]byte, max(size, 2*pageSize)))
+	node.SetHeader(BNODE_LEAF, uint16(len(kvs)))
+	for i, kv := range kvs {
+		node.CopyPtrAndKV(uint16(i), 0, kv.key, kv.val)
+	}
+	return node
+}
+
+// requireSplit checks that the split nodes each fit on a page and together hold the original kvs in order
+func requireSplit(t *testing.T, pageSize int, kvs []kv, nsplit uint16, split [3]BNode) {
+	t.Helper()
+	var got []kv
+	for _, node := range split[:nsplit] {
+		require.LessOrEqual(t, node.NumBytes(), uint32(constant.NodeCapacity(pageSize)))
+		require.Len(t, node, pageSize)
+		require.NotZero(t, node.NumKeys())
+		for i := uint16(0); i < node.NumKeys(); i++ {
+			got = append(got, kv{node.GetKey(i), node.GetVal(i)})
+		}
+	}
+	require.Equal(t, len(kvs), len(got))
+	for i := range kvs {
+		require.Equal(t, kvs[i].key, got[i].key, "key %d", i)
+		require.Equal(t, kvs[i].val, got[i].val, "val %d", i)
+	}
+}
+
+func TestSplit3(t *testing.T) {
+	maxKey := func(prefix byte) []byte {
+		return append([]byte{prefix}, bytes.Repeat([]byte{'k'}, constant.BTREE_MAX_KEY_SIZE-1)...)
+	}
+	for _, pageSize := range pageSizes {
+		maxVal := bytes.Repeat([]byte{'v'}, constant.MaxValSize(pageSize))
+		halfVal := bytes.Repeat([]byte{'v'}, pageSize/2-8)
+
+		tests := []struct {
+			name       string
+			kvs        []kv
+			wantNSplit uint16
+		}{
+			{"small node is not split", []kv{{[]byte("a"), []byte("1")}, {[]byte("b"), []byte("2")}}, 1},
+			{"single max kv fits a page", []kv{{maxKey('a'), maxVal}}, 1},
+			{"two max kvs", []kv{{maxKey('a'), maxVal}, {maxKey('b'), maxVal}}, 2},
+			{"max kv between two halves", []kv{
+				{[]byte("a"), halfVal},
+				{maxKey('b'), maxVal},
+				{[]byte("c"), halfVal},
+			}, 3},
+		}
+		for _, tt := range tests {
+			for _, compress := range []bool{false, true} {
+				t.Run(fmt.Sprintf("%s/page%d/compress=%v", tt.name, pageSize, compress), func(t *testing.T) {
+					nsplit, split := makeLeaf(pageSize, tt.kvs).Split3(pageSize, compress)
+					require.Equal(t, tt.wantNSplit, nsplit)
+					requireSplit(t, pageSize, tt.kvs, nsplit, split)
+				})
+			}
+		}
+	}
+}
+
+// TestSplit3Random fills a page with random kvs then adds one more, like BTree.insert does
+func TestSplit3Random(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randBytes := func(max int) []byte {
+		b := make([]byte, 1+rng.Intn(max))
+		rng.Read(b)
+		return b
+	}
+	for iter := 0; iter < 1000; iter++ {
+		pageSize := pageSizes[iter%len(pageSizes)]
+		var kvs []kv
+		size := constant.HEADER_SIZE
+		for {
+			next := kv{randBytes(constant.BTREE_MAX_KEY_SIZE - 1), randBytes(constant.MaxValSize(pageSize) - 1)}
+			nextSize := constant.ENTRY_OVERHEAD + len(next.key) + len(next.val)
+			if size+nextSize > constant.NodeCapacity(pageSize) {
+				// the last kv overflows the page
+				kvs = append(kvs, next)
+				break
+			}
+			kvs = append(kvs, next)
+			size += nextSize
+		}
+		nsplit, split := makeLeaf(pageSize, kvs).Split3(pageSize, iter%2 == 0)
+		require.GreaterOrEqual(t, nsplit, uint16(1), fmt.Sprintf("iter %d", iter))
+		requireSplit(t, pageSize, kvs, nsplit, split)
+	}
+}
+
+// makeFullNode builds a node of the given type filled with keys of keySize bytes, until the page is full.
+// keys are zero padded numbers, so they are sorted.
+func makeFullNode(btype uint16, keySize int, valSize int) (BNode, [][]byte) {
+	var keys [][]byte
+	size := constant.HEADER_SIZE
+	for {
+		next := constant.ENTRY_OVERHEAD + keySize + valSize
+		if size+next > constant.DEFAULT_PAGE_SIZE {
+			break
+		}
+		size += next
+		keys = append(keys, []byte(fmt.Sprintf("%0*d", keySize, 2*len(keys))))
+	}
+	node := BNode(make([]byte, constant.DEFAULT_PAGE_SIZE))
+	node.SetHeader(btype, uint16(len(keys)))
+	val := bytes.Repeat([]byte{'v'}, valSize)
+	for i, key := range keys {
+		node.CopyPtrAndKV(uint16(i), 0, key, val)
+	}
+	return node, keys
+}
+
+func TestLookupLE(t *testing.T) {
+	for _, nkeys := range []int{1, 2, 3, 10, 101} {
+		node := BNode(make([]byte, 2*constant.DEFAULT_PAGE_SIZE))
+		node.SetHeader(BNODE_LEAF, uint16(nkeys))
+		// the first key is the dummy key
+		node.CopyPtrAndKV(0, 0, nil, nil)
+		for i := 1; i < nkeys; i++ {
+			node.CopyPtrAndKV(uint16(i), 0, []byte(fmt.Sprintf("%04d", 2*i)), nil)
+		}
+		for i := 0; i <= 2*nkeys+1; i++ {
+			key := []byte(fmt.Sprintf("%04d", i))
+			require.Equal(t, node.lookupLELinear(key, comparator.Bytewise), node.LookupLE(key, comparator.Bytewise), "nkeys %d key %s", nkeys, key)
+		}
+		// a key smaller than every key but the dummy one
+		require.Equal(t, uint16(0), node.LookupLE([]byte("0"), comparator.Bytewise))
+	}
+}
+
+func BenchmarkLookupLE(b *testing.B) {
+	fills := []struct {
+		name    string
+		btype   uint16
+		keySize int
+		valSize int
+	}{
+		{"leaf/key16/val8", BNODE_LEAF, 16, 8},
+		{"leaf/key32/val100", BNODE_LEAF, 32, 100},
+		{"node/key16", BNODE_NODE, 16, 0},
+		{"node/key64", BNODE_NODE, 64, 0},
+	}
+	for _, fill := range fills {
+		node, keys := makeFullNode(fill.btype, fill.keySize, fill.valSize)
+		// look up existing keys and keys that fall between them
+		lookups := make([][]byte, 0, 2*len(keys))
+		for i := range keys {
+			lookups = append(lookups, keys[i], []byte(fmt.Sprintf("%0*d", fill.keySize, 2*i+1)))
+		}
+		b.Run(fmt.Sprintf("%s/nkeys%d/binary", fill.name, len(keys)), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				node.LookupLE(lookups[i%len(lookups)], comparator.Bytewise)
+			}
+		})
+		b.Run(fmt.Sprintf("%s/nkeys%d/linear", fill.name, len(keys)), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				node.lookupLELinear(lookups[i%len(lookups)], comparator.Bytewise)
+			}
+		})
+	}
+}
+
+// makePrefixedLeaf builds an oversized leaf of sorted keys sharing a long prefix
+func makePrefixedLeaf(pageSize int, n int) (BNode, []kv) {
+	var kvs []kv
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("tenant/123/object/%06d", i))
+		kvs = append(kvs, kv{key, []byte(fmt.Sprintf("v%d", i))})
+	}
+	return makeLeaf(pageSize, kvs), kvs
+}
+
+func TestPrefixLayout(t *testing.T) {
+	pageSize := constant.DEFAULT_PAGE_SIZE
+	leaf, kvs := makePrefixedLeaf(pageSize, 80)
+	node := leaf.Fit(pageSize, true)
+	require.Equal(t, []byte("tenant/123/object/0000"), node.Prefix())
+	require.Equal(t, uint16(BNODE_LEAF), node.Type())
+	require.Less(t, node.NumBytes(), leaf.NumBytes())
+	require.Equal(t, leaf.NumBytes(), node.UncompressedBytes())
+	requireSplit(t, pageSize, kvs, 1, [3]BNode{node})
+
+	probes := [][]byte{[]byte("a"), []byte("tenant"), []byte("tenant/123/object/0000"), []byte("z")}
+	for i := 0; i < 2*len(kvs); i++ {
+		probes = append(probes, []byte(fmt.Sprintf("tenant/123/object/%06d", i)), []byte(fmt.Sprintf("tenant/123/object/%06d0", i)))
+	}
+	for _, key := range probes {
+		for i := uint16(0); i < node.NumKeys(); i++ {
+			require.Equal(t, bytes.Compare(node.GetKey(i), key), node.CompareKey(i, key, comparator.Bytewise), "idx %d key %s", i, key)
+		}
+		require.Equal(t, leaf.LookupLE(key, comparator.Bytewise), node.LookupLE(key, comparator.Bytewise), "key %s", key)
+		require.Equal(t, node.lookupLELinear(key, comparator.Bytewise), node.LookupLE(key, comparator.Bytewise), "key %s", key)
+	}
+
+	t.Run("no prefix without compress", func(t *testing.T) {
+		require.Nil(t, leaf.Fit(pageSize, false).Prefix())
+	})
+
+	t.Run("copying from a compressed node", func(t *testing.T) {
+		new := BNode(make([]byte, 2*pageSize))
+		LeafInsert(new, node, 1, []byte("tenant/123/object/000000a"), []byte("new"))
+		require.Nil(t, new.Prefix())
+		require.Equal(t, []byte("tenant/123/object/000000a"), new.GetKey(1))
+		require.Equal(t, kvs[1].key, new.GetKey(2))
+	})
+}
+
+func TestSplit3Compressed(t *testing.T) {
+	pageSize := constant.DEFAULT_PAGE_SIZE
+	// an uncompressed node of that many KVs needs 2 pages
+	leaf, kvs := makePrefixedLeaf(pageSize, 180)
+	nsplit, split := leaf.Split3(pageSize, false)
+	require.Equal(t, uint16(2), nsplit)
+	requireSplit(t, pageSize, kvs, nsplit, split)
+
+	// but they fit in a single compressed page
+	nsplit, split = leaf.Split3(pageSize, true)
+	require.Equal(t, uint16(1), nsplit)
+	requireSplit(t, pageSize, kvs, nsplit, split)
+
+	// the compressed size is what decides the split
+	leaf, kvs = makePrefixedLeaf(pageSize, 300)
+	nsplit, split = leaf.Split3(pageSize, true)
+	require.Equal(t, uint16(2), nsplit)
+	requireSplit(t, pageSize, kvs, nsplit, split)
+	for _, node := range split[:nsplit] {
+		require.NotEmpty(t, node.Prefix())
+	}
+}
@@ -0,0 +1,45 @@
+package bnode
+
+import (
+	"encoding/binary"
+	"trees/internal/errors"
+	"trees/pkg/btree/constant"
+	"trees/pkg/btree/types"
+)
+
+// BNODE_OVERFLOW pages hold a chunk of a value that is too big to be stored in a leaf.
+// The chunks of a value are chained together with the next pointer.
+// | type | nkeys=0 | next | size | data |
+// |  2B  |   2B    |  8B  |  2B  | ...  |
+const BNODE_OVERFLOW = 3
+
+const OVERFLOW_HEADER_SIZE = constant.HEADER_SIZE + 8 + 2
+
+// OverflowCapacity returns the number of value bytes that fit in a single overflow page
+func OverflowCapacity(pageSize int) int {
+	return constant.NodeCapacity(pageSize) - OVERFLOW_HEADER_SIZE
+}
+
+// NewOverflowPage creates an overflow page holding data and pointing at the next page of the chain
+func NewOverflowPage(pageSize int, next types.PagePtr, data []byte) BNode {
+	errors.Assert(len(data) <= OverflowCapacity(pageSize), "len(data) <= OverflowCapacity(pageSize)")
+	node := BNode(make([]byte, pageSize))
+	node.SetHeader(BNODE_OVERFLOW, 0)
+	binary.LittleEndian.PutUint64(node[constant.HEADER_SIZE:], uint64(next))
+	binary.LittleEndian.PutUint16(node[constant.HEADER_SIZE+8:], uint16(len(data)))
+	copy(node[OVERFLOW_HEADER_SIZE:], data)
+	return node
+}
+
+// OverflowNext returns the next page of the chain, or NilPagePtr for the last page
+func (node BNode) OverflowNext() types.PagePtr {
+	errors.Assert(node.Type() == BNODE_OVERFLOW, "not an overflow page")
+	return types.PagePtr(binary.LittleEndian.Uint64(node[constant.HEADER_SIZE:]))
+}
+
+// OverflowData returns the chunk of value held by the page
+func (node BNode) OverflowData() []byte {
+	errors.Assert(node.Type() == BNODE_OVERFLOW, "not an overflow page")
+	size := uint32(binary.LittleEndian.Uint16(node[constant.HEADER_SIZE+8:]))
+	return node[OVERFLOW_HEADER_SIZE : OVERFLOW_HEADER_SIZE+size]
+}
@@ -0,0 +1,152 @@
+package bnode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"trees/internal/errors"
+	"trees/pkg/btree/comparator"
+	"trees/pkg/btree/constant"
+)
+
+// BNODE_PREFIX is a flag of the node type, for nodes using the prefix compression layout.
+// These nodes store the prefix shared by all their keys once, right after the header,
+// and their KVs only hold the key suffixes:
+// | type | nkeys | plen | prefix | pointers | offsets | key-values |
+// |  2B  |   2B  |  2B  |  plen  |    ...   |   ...   |    ...     |
+// nodes without the flag use the original layout, and are read as if their prefix was empty.
+const BNODE_PREFIX = 0x100
+
+func (node BNode) hasPrefix() bool {
+	return binary.LittleEndian.Uint16(node[0:2])&BNODE_PREFIX != 0
+}
+
+// Prefix returns the prefix shared by all the keys of the node.
+// it's empty for nodes that don't use the prefix compression layout.
+func (node BNode) Prefix() []byte {
+	if !node.hasPrefix() {
+		return nil
+	}
+	plen := uint32(binary.LittleEndian.Uint16(node[constant.HEADER_SIZE:]))
+	return node[constant.HEADER_SIZE+2 : constant.HEADER_SIZE+2+plen]
+}
+
+// size of the header, including the prefix
+func (node BNode) hdrSize() uint32 {
+	if !node.hasPrefix() {
+		return constant.HEADER_SIZE
+	}
+	return prefixHdrSize(len(node.Prefix()))
+}
+
+func prefixHdrSize(plen int) uint32 {
+	if plen == 0 {
+		return constant.HEADER_SIZE
+	}
+	return constant.HEADER_SIZE + 2 + uint32(plen)
+}
+
+// SetPrefixHeader sets up the header of a node using the prefix compression layout.
+// all the keys later copied into the node must start with prefix.
+func (node BNode) SetPrefixHeader(btype uint16, nkeys uint16, prefix []byte) {
+	node.SetHeader(btype|BNODE_PREFIX, nkeys)
+	binary.LittleEndian.PutUint16(node[constant.HEADER_SIZE:], uint16(len(prefix)))
+	copy(node[constant.HEADER_SIZE+2:], prefix)
+}
+
+// CompareKey compares the key at index idx with key, like cmp.Compare(node.GetKey(idx), key).
+// with the bytewise order, it doesn't rebuild the key for nodes using the prefix compression layout.
+func (node BNode) CompareKey(idx uint16, key []byte, cmp *comparator.Comparator) int {
+	if !comparator.IsBytewise(cmp) {
+		return cmp.Compare(node.GetKey(idx), key)
+	}
+	suffix := node.keySuffix(idx)
+	prefix := node.Prefix()
+	n := min(len(prefix), len(key))
+	if cmp := bytes.Compare(prefix[:n], key[:n]); cmp != 0 {
+		return cmp
+	}
+	if len(key) < len(prefix) {
+		return 1 // the key is a strict prefix of the node prefix
+	}
+	return bytes.Compare(suffix, key[len(prefix):])
+}
+
+// CommonPrefixLen returns the length of the longest common prefix of a and b
+func CommonPrefixLen(a []byte, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// NodeBytes returns the size in bytes of a node holding nkeys KVs, whose full size (with the full keys) is kvBytes,
+// when plen bytes of prefix are shared by the keys.
+func NodeBytes(nkeys uint16, kvBytes uint32, plen int) uint32 {
+	return prefixHdrSize(plen) + 12*uint32(nkeys) + kvBytes - uint32(nkeys)*uint32(plen)
+}
+
+// full size of the KVs [begin, end), with the full keys
+func (node BNode) kvBytes(begin uint16, end uint16) uint32 {
+	plen := uint32(len(node.Prefix()))
+	return node.GetOffset(end) - node.GetOffset(begin) + uint32(end-begin)*plen
+}
+
+// rangeLayout returns the prefix length and the size of a node holding the KVs [begin, end).
+// a prefix is only used with compress, and when it makes the node smaller.
+func (node BNode) rangeLayout(begin uint16, end uint16, compress bool) (int, uint32) {
+	nkeys := end - begin
+	kvBytes := node.kvBytes(begin, end)
+	size := NodeBytes(nkeys, kvBytes, 0)
+	if !compress || nkeys == 0 {
+		return 0, size
+	}
+	// the keys are sorted, so the first and last keys share the prefix of all the keys
+	plen := CommonPrefixLen(node.GetKey(begin), node.GetKey(end-1))
+	if compressed := NodeBytes(nkeys, kvBytes, plen); compressed < size {
+		return plen, compressed
+	}
+	return 0, size
+}
+
+func (node BNode) rangeBytes(begin uint16, end uint16, compress bool) uint32 {
+	_, size := node.rangeLayout(begin, end, compress)
+	return size
+}
+
+// UncompressedBytes returns the size of the node with the original layout
+func (node BNode) UncompressedBytes() uint32 {
+	return NodeBytes(node.NumKeys(), node.kvBytes(0, node.NumKeys()), 0)
+}
+
+// MergedBytes returns the size of a node holding the KVs of left followed by the KVs of right
+func MergedBytes(left BNode, right BNode, compress bool) uint32 {
+	nkeys := left.NumKeys() + right.NumKeys()
+	kvBytes := left.kvBytes(0, left.NumKeys()) + right.kvBytes(0, right.NumKeys())
+	size := NodeBytes(nkeys, kvBytes, 0)
+	if !compress || left.NumKeys() == 0 || right.NumKeys() == 0 {
+		// an empty node can't tell much about the prefix, just be conservative
+		return size
+	}
+	plen := CommonPrefixLen(left.GetKey(0), right.GetKey(right.NumKeys()-1))
+	return min(size, NodeBytes(nkeys, kvBytes, plen))
+}
+
+// copy the KVs [begin, end) into a new page
+func (old BNode) copyRange(begin uint16, end uint16, pageSize int, compress bool) BNode {
+	plen, size := old.rangeLayout(begin, end, compress)
+	errors.Assert(size <= uint32(constant.NodeCapacity(pageSize)), "size <= NodeCapacity(pageSize)")
+	if !old.hasPrefix() && plen == 0 && begin == 0 && end == old.NumKeys() {
+		return old[:pageSize] // nothing to change
+	}
+	new := BNode(make([]byte, pageSize))
+	if plen > 0 {
+		new.SetPrefixHeader(old.Type(), end-begin, old.GetKey(begin)[:plen])
+	} else {
+		new.SetHeader(old.Type(), end-begin)
+	}
+	new.CopyPtrsAndKVs(old, 0, begin, end-begin)
+	return new
+}
@@ -3,9 +3,9 @@ package btree
 // We follow the BTree implementation from https://build-your-own.org/database/04_btree_code_1
 
 import (
-	"bytes"
 	"trees/internal/errors"
 	"trees/pkg/btree/bnode"
+	"trees/pkg/btree/comparator"
 	"trees/pkg/btree/constant"
 	"trees/pkg/btree/pagemanager"
 	"trees/pkg/btree/types"
@@ -16,6 +16,116 @@ type BTree struct {
 	RootPtr types.PagePtr
 	// interface for managing on-disk pages
 	pageManager pagemanager.PageManager
+	// size of the pages in bytes, no node is bigger than a page
+	pageSize int
+	// whether new nodes use the prefix compression layout
+	compress bool
+	// order of the keys
+	cmp *comparator.Comparator
+	// the pages of the running Insert or Delete
+	update struct {
+		// the new pages, deallocated if the update fails
+		allocated []types.PagePtr
+		// the pages of the old version, deallocated once the new root is set
+		freed []types.PagePtr
+	}
+}
+
+// Options are the settings of a tree, chosen when it is created
+type Options struct {
+	// PageSize is the size of the pages in bytes, it must satisfy constant.ValidPageSize.
+	// defaults to constant.DEFAULT_PAGE_SIZE
+	PageSize int
+	// PrefixCompression stores the prefix shared by the keys of a node only once.
+	// nodes written without it remain readable, so it can be turned on for an existing tree,
+	// but it can't be turned off once some nodes were written with it.
+	PrefixCompression bool
+	// Comparator is the order of the keys, defaults to comparator.Bytewise.
+	// it can't be changed once the tree has some keys.
+	// prefix compression requires a comparator.PrefixContiguous order.
+	Comparator *comparator.Comparator
+}
+
+// New creates an empty tree whose pages are managed by pageManager
+func New(pageManager pagemanager.PageManager, opts Options) *BTree {
+	if opts.PageSize == 0 {
+		opts.PageSize = constant.DEFAULT_PAGE_SIZE
+	}
+	errors.Assert(constant.ValidPageSize(opts.PageSize), "invalid page size")
+	if opts.Comparator == nil {
+		opts.Comparator = comparator.Bytewise
+	}
+	errors.Assert(!opts.PrefixCompression || opts.Comparator.PrefixContiguous,
+		"prefix compression requires a prefix contiguous comparator")
+	return &BTree{
+		pageManager: pageManager,
+		pageSize:    opts.PageSize,
+		compress:    opts.PrefixCompression,
+		cmp:         opts.Comparator,
+	}
+}
+
+// allocate a temporary node, big enough for the full keys of the src nodes plus extra bytes.
+// the result gets fitted into pages with Split3 or Fit.
+func (tree *BTree) tempNode(extra int, srcs ...bnode.BNode) bnode.BNode {
+	size := extra
+	for _, src := range srcs {
+		// nodes using the prefix compression layout are bigger once uncompressed
+		size += int(src.UncompressedBytes())
+	}
+	return make(bnode.BNode, max(size, 2*tree.pageSize))
+}
+
+// node reads the node at ptr.
+// a pointer can lead to a valid page of another kind, like an overflow page, when the tree is corrupted.
+func (tree *BTree) node(ptr types.PagePtr) bnode.BNode {
+	node := bnode.BNode(tree.pageManager.Get(ptr))
+	if typ := node.Type(); typ != bnode.BNODE_LEAF && typ != bnode.BNODE_NODE {
+		corrupted(ptr, "node type %d, expected a leaf or an internal node", typ)
+	}
+	return node
+}
+
+// newPage allocates a page for a node of the running update
+func (tree *BTree) newPage(node []byte) types.PagePtr {
+	ptr := tree.pageManager.New(node)
+	tree.update.allocated = append(tree.update.allocated, ptr)
+	return ptr
+}
+
+// freePage deallocates a page of the old version once the running update is done:
+// until then, the tree is unchanged if a corrupted page interrupts the update.
+func (tree *BTree) freePage(ptr types.PagePtr) {
+	tree.update.freed = append(tree.update.freed, ptr)
+}
+
+// commitUpdate ends the running update once the new root is set
+func (tree *BTree) commitUpdate() {
+	for _, ptr := range tree.update.freed {
+		tree.pageManager.Del(ptr)
+	}
+	tree.update.allocated, tree.update.freed = nil, nil
+}
+
+// abortUpdate ends the running update unless it's committed, the tree is left unchanged
+func (tree *BTree) abortUpdate() {
+	for _, ptr := range tree.update.allocated {
+		tree.pageManager.Del(ptr)
+	}
+	tree.update.allocated, tree.update.freed = nil, nil
+}
+
+// PageSize returns the size of the tree pages in bytes
+func (tree *BTree) PageSize() int {
+	return tree.pageSize
+}
+
+// Comparator returns the order of the keys of the tree
+func (tree *BTree) Comparator() *comparator.Comparator {
+	if tree.cmp == nil {
+		return comparator.Bytewise
+	}
+	return tree.cmp
 }
 
 // replace a kid at idx with one or multiple kids
@@ -26,30 +136,32 @@ func nodeReplaceKidN(
 	new.SetHeader(bnode.BNODE_NODE, old.NumKeys()+inc-1)
 	new.CopyPtrsAndKVs(old, 0, 0, idx)
 	for i, node := range kids {
-		new.CopyPtrAndKV(idx+uint16(i), tree.pageManager.New(node), node.GetKey(0), nil)
+		new.CopyPtrAndKV(idx+uint16(i), tree.newPage(node), node.GetKey(0), nil)
 		//                ^position      ^pointer                   ^key            ^val
 	}
 	new.CopyPtrsAndKVs(old, idx+inc, idx+1, old.NumKeys()-(idx+1))
 }
 
-// insert a KV into a node, the result might need to be split.
+// insert a KV into the node at ptr, the result might need to be split.
 // the caller is responsible for deallocating the input node
 // and splitting and allocating result nodes.
-func (tree *BTree) insert(bNode bnode.BNode, key []byte, val []byte) bnode.BNode {
+func (tree *BTree) insert(ptr types.PagePtr, key []byte, val []byte) bnode.BNode {
+	bNode := tree.node(ptr)
 	errors.Assert(len(key) < constant.BTREE_MAX_KEY_SIZE, "key is too big")
-	errors.Assert(len(val) < constant.BTREE_MAX_VAL_SIZE, "val is too big")
+	errors.Assert(len(val) < constant.MaxValSize(tree.pageSize), "val is too big")
 	// the result node.
 	// it's allowed to be bigger than 1 page and will be split if so
-	new := make(bnode.BNode, 2*constant.BTREE_PAGE_SIZE)
+	new := tree.tempNode(tree.pageSize, bNode)
 
 	// where to insert the key?
-	idx := bNode.LookupLE(key)
+	idx := bNode.LookupLE(key, tree.cmp)
 	// act depending on the node type
 	switch bNode.Type() {
 	case bnode.BNODE_LEAF:
 		// leaf, node.getKey(idx) <= key
-		if bytes.Equal(key, bNode.GetKey(idx)) {
+		if bNode.CompareKey(idx, key, tree.cmp) == 0 {
 			// found the key, update it.
+			tree.freeVal(ptr, bNode.GetVal(idx))
 			bnode.LeafUpdate(new, bNode, idx, key, val)
 		} else {
 			// insert it after the position.
@@ -71,78 +183,108 @@ func (tree *BTree) nodeInsert(
 ) {
 	kptr := node.GetPtr(idx)
 	// recursive insertion to the kid node
-	knode := tree.insert(tree.pageManager.Get(kptr), key, val)
+	knode := tree.insert(kptr, key, val)
 	// split the result
-	nsplit, split := knode.Split3()
+	nsplit, split := knode.Split3(tree.pageSize, tree.compress)
 	// deallocate the kid node
-	tree.pageManager.Del(kptr)
+	tree.freePage(kptr)
 	// update the kid links
 	nodeReplaceKidN(tree, new, node, idx, split[:nsplit]...)
 }
 
-// insert a new key or update an existing key
-func (tree *BTree) Insert(key []byte, val []byte) {
+// Insert inserts a new key or updates an existing key.
+// values too big to fit in a leaf are stored in overflow pages.
+// it returns ErrEmptyKey, ErrKeyTooLarge or ErrValueTooLarge for a KV that can't be inserted,
+// and leaves the tree untouched. a corrupted page interrupts the update with an error matching
+// ErrCorruptPage, and leaves the tree untouched too.
+func (tree *BTree) Insert(key []byte, val []byte) (err error) {
+	if err := checkKV(key, val); err != nil {
+		return err
+	}
+	defer tree.abortUpdate()
+	defer pagemanager.RecoverCorruption(&err)
+	val = tree.encodeVal(val, tree.newPage)
 	if tree.RootPtr == constant.NilPagePtr {
 		// create the first node
-		root := make(bnode.BNode, constant.BTREE_PAGE_SIZE)
+		root := make(bnode.BNode, tree.pageSize)
 		root.SetHeader(bnode.BNODE_LEAF, 2)
 		// a dummy key, this makes the tree cover the whole key space.
 		// thus a lookup can always find a containing node.
 		root.CopyPtrAndKV(0, 0, nil, nil)
 		root.CopyPtrAndKV(1, 0, key, val)
-		tree.RootPtr = tree.pageManager.New(root)
-		return
+		tree.RootPtr = tree.newPage(root)
+		tree.commitUpdate()
+		return nil
 	}
 
-	rootNode := tree.pageManager.Get(tree.RootPtr)
-	defer tree.pageManager.Del(tree.RootPtr)
-	node := tree.insert(rootNode, key, val)
-	nsplit, split := node.Split3()
+	oldRoot := tree.RootPtr
+	tree.setRoot(tree.insert(oldRoot, key, val))
+	tree.freePage(oldRoot)
+	tree.commitUpdate()
+	return nil
+}
+
+// setRoot allocates the updated root node, which might need to be split
+func (tree *BTree) setRoot(node bnode.BNode) {
+	nsplit, split := node.Split3(tree.pageSize, tree.compress)
 	if nsplit > 1 {
 		// the root was split, add a new level.
-		root := make(bnode.BNode, constant.BTREE_PAGE_SIZE)
+		root := make(bnode.BNode, tree.pageSize)
 		root.SetHeader(bnode.BNODE_NODE, nsplit)
 		for i, knode := range split[:nsplit] {
-			ptr, key := tree.pageManager.New(knode), knode.GetKey(0)
+			ptr, key := tree.newPage(knode), knode.GetKey(0)
 			root.CopyPtrAndKV(uint16(i), ptr, key, nil)
 		}
-		tree.RootPtr = tree.pageManager.New(root)
+		tree.RootPtr = tree.newPage(root)
 	} else {
-		tree.RootPtr = tree.pageManager.New(split[0])
+		tree.RootPtr = tree.newPage(split[0])
 	}
 }
 
 // remove a key from a leaf node
-func leafDelete(new bnode.BNode, old bnode.BNode, idx uint16)
+func leafDelete(new bnode.BNode, old bnode.BNode, idx uint16) {
+	new.SetHeader(bnode.BNODE_LEAF, old.NumKeys()-1)
+	new.CopyPtrsAndKVs(old, 0, 0, idx)
+	new.CopyPtrsAndKVs(old, idx, idx+1, old.NumKeys()-(idx+1))
+}
 
 // merge 2 nodes into 1
-func nodeMerge(new bnode.BNode, left bnode.BNode, right bnode.BNode)
+func nodeMerge(new bnode.BNode, left bnode.BNode, right bnode.BNode) {
+	new.SetHeader(left.Type(), left.NumKeys()+right.NumKeys())
+	new.CopyPtrsAndKVs(left, 0, 0, left.NumKeys())
+	new.CopyPtrsAndKVs(right, left.NumKeys(), 0, right.NumKeys())
+}
 
 // replace 2 adjacent links with 1
 func nodeReplace2Kid(
 	new bnode.BNode, old bnode.BNode, idx uint16, ptr types.PagePtr, key []byte,
-)
+) {
+	new.SetHeader(bnode.BNODE_NODE, old.NumKeys()-1)
+	new.CopyPtrsAndKVs(old, 0, 0, idx)
+	new.CopyPtrAndKV(idx, ptr, key, nil)
+	new.CopyPtrsAndKVs(old, idx+1, idx+2, old.NumKeys()-(idx+2))
+}
 
 // should the updated kid be merged with a sibling?
 func shouldMerge(
 	tree *BTree, node bnode.BNode,
 	idx uint16, updated bnode.BNode,
 ) (int, bnode.BNode) {
-	if updated.NumBytes() > constant.BTREE_PAGE_SIZE/4 {
+	if updated.NumBytes() > uint32(constant.NodeCapacity(tree.pageSize))/4 {
 		return 0, bnode.BNode{}
 	}
 
 	if idx > 0 {
-		sibling := bnode.BNode(tree.pageManager.Get(node.GetPtr(idx - 1)))
-		merged := sibling.NumBytes() + updated.NumBytes() - constant.HEADER_SIZE
-		if merged <= constant.BTREE_PAGE_SIZE {
+		sibling := tree.node(node.GetPtr(idx - 1))
+		merged := bnode.MergedBytes(sibling, updated, tree.compress)
+		if merged <= uint32(constant.NodeCapacity(tree.pageSize)) {
 			return -1, sibling // left
 		}
 	}
 	if idx+1 < node.NumKeys() {
-		sibling := bnode.BNode(tree.pageManager.Get(node.GetPtr(idx + 1)))
-		merged := sibling.NumBytes() + updated.NumBytes() - constant.HEADER_SIZE
-		if merged <= constant.BTREE_PAGE_SIZE {
+		sibling := tree.node(node.GetPtr(idx + 1))
+		merged := bnode.MergedBytes(updated, sibling, tree.compress)
+		if merged <= uint32(constant.NodeCapacity(tree.pageSize)) {
 			return +1, sibling // right
 		}
 	}
@@ -150,32 +292,65 @@ func shouldMerge(
 }
 
 // delete a key from the tree
-func treeDelete(tree *BTree, node bnode.BNode, key []byte) bnode.BNode
+// an empty node is returned if the key was not found.
+// the result might need to be split, like the result of an insertion.
+func treeDelete(tree *BTree, ptr types.PagePtr, key []byte) bnode.BNode {
+	node := tree.node(ptr)
+	// where to find the key?
+	idx := node.LookupLE(key, tree.cmp)
+	// act depending on the node type
+	switch node.Type() {
+	case bnode.BNODE_LEAF:
+		if node.CompareKey(idx, key, tree.cmp) != 0 {
+			return bnode.BNode{} // not found
+		}
+		// delete the key in the leaf
+		tree.freeVal(ptr, node.GetVal(idx))
+		new := tree.tempNode(0, node)
+		leafDelete(new, node, idx)
+		return new
+	case bnode.BNODE_NODE:
+		return nodeDelete(tree, node, idx, key)
+	default:
+		panic("bad node!")
+	}
+}
 
 // delete a key from an internal node; part of the treeDelete()
 func nodeDelete(tree *BTree, node bnode.BNode, idx uint16, key []byte) bnode.BNode {
 	// recurse into the kid
 	kptr := node.GetPtr(idx)
-	updated := treeDelete(tree, tree.pageManager.Get(kptr), key)
+	updated := treeDelete(tree, kptr, key)
 	if len(updated) == 0 {
 		return bnode.BNode{} // not found
 	}
-	tree.pageManager.Del(kptr)
+	tree.freePage(kptr)
 
-	new := bnode.BNode(make([]byte, constant.BTREE_PAGE_SIZE))
+	// the first key of the kid might have changed, and the kid might be split in up to 3 nodes:
+	// leave room for 3 bigger keys
+	new := tree.tempNode(3*(constant.BTREE_MAX_KEY_SIZE+constant.ENTRY_OVERHEAD), node)
+	// a bigger first key in a grandkid can make the kid too big, split it like an insertion
+	nsplit, split := updated.Split3(tree.pageSize, tree.compress)
+	if nsplit > 1 {
+		nodeReplaceKidN(tree, new, node, idx, split[:nsplit]...)
+		return new
+	}
+	updated = split[0]
 	// check for merging
 	mergeDir, sibling := shouldMerge(tree, node, idx, updated)
 	switch {
 	case mergeDir < 0: // left
-		merged := bnode.BNode(make([]byte, constant.BTREE_PAGE_SIZE))
+		merged := tree.tempNode(0, sibling, updated)
 		nodeMerge(merged, sibling, updated)
-		tree.pageManager.Del(node.GetPtr(idx - 1))
-		nodeReplace2Kid(new, node, idx-1, tree.pageManager.New(merged), merged.GetKey(0))
+		merged = merged.Fit(tree.pageSize, tree.compress)
+		tree.freePage(node.GetPtr(idx - 1))
+		nodeReplace2Kid(new, node, idx-1, tree.newPage(merged), merged.GetKey(0))
 	case mergeDir > 0: // right
-		merged := bnode.BNode(make([]byte, constant.BTREE_PAGE_SIZE))
+		merged := tree.tempNode(0, updated, sibling)
 		nodeMerge(merged, updated, sibling)
-		tree.pageManager.Del(node.GetPtr(idx + 1))
-		nodeReplace2Kid(new, node, idx, tree.pageManager.New(merged), merged.GetKey(0))
+		merged = merged.Fit(tree.pageSize, tree.compress)
+		tree.freePage(node.GetPtr(idx + 1))
+		nodeReplace2Kid(new, node, idx, tree.newPage(merged), merged.GetKey(0))
 	case mergeDir == 0 && updated.NumKeys() == 0:
 		errors.Assert(node.NumKeys() == 1 && idx == 0, "1 empty child but no sibling")
 		new.SetHeader(bnode.BNODE_NODE, 0) // the parent becomes empty too
@@ -185,20 +360,60 @@ func nodeDelete(tree *BTree, node bnode.BNode, idx uint16, key []byte) bnode.BNo
 	return new
 }
 
-// delete a key and returns whether the key was there
-func (tree *BTree) Delete(key []byte) bool {
-	if tree.RootPtr == 0 {
-		return false
+// Delete deletes a key and returns whether the key was there.
+// a corrupted page interrupts it with an error matching ErrCorruptPage, like Insert.
+func (tree *BTree) Delete(key []byte) (deleted bool, err error) {
+	// the empty key is reserved for the dummy key, which must never be removed
+	if tree.RootPtr == constant.NilPagePtr || len(key) == 0 {
+		return false, nil
 	}
-	node := treeDelete(tree, tree.pageManager.Get(tree.RootPtr), key)
+	defer tree.abortUpdate()
+	defer pagemanager.RecoverCorruption(&err)
+	node := treeDelete(tree, tree.RootPtr, key)
 	if len(node) == 0 {
-		tree.pageManager.Del(tree.RootPtr)
+		return false, nil // not found, the tree is untouched
+	}
+	tree.freePage(tree.RootPtr)
+	switch {
+	case node.Type() == bnode.BNODE_NODE && node.NumKeys() == 1:
+		// the root has a single kid, remove a level.
+		tree.RootPtr = node.GetPtr(0)
+	case node.Type() == bnode.BNODE_LEAF && node.NumKeys() == 1:
+		// only the dummy key is left, the tree is empty.
 		tree.RootPtr = constant.NilPagePtr
-	} else {
-		tree.RootPtr = tree.pageManager.New(node)
+	default:
+		// the root might have to be split, adding a level
+		tree.setRoot(node)
 	}
-	// TODO: are we sure that the key was there?
-	return true
+	tree.commitUpdate()
+	return true, nil
 }
 
-func (tree *BTree) Get(key []byte) ([]byte, bool)
+// Get returns a key's value from the tree and whether it was found.
+// a corrupted page makes it fail with an error matching ErrCorruptPage.
+func (tree *BTree) Get(key []byte) (val []byte, ok bool, err error) {
+	// the empty key is reserved for the dummy key of the leftmost nodes
+	if tree.RootPtr == constant.NilPagePtr || len(key) == 0 {
+		return nil, false, nil
+	}
+	defer pagemanager.RecoverCorruption(&err)
+	ptr := tree.RootPtr
+	node := tree.node(ptr)
+	for {
+		// node.getKey(idx) <= key
+		idx := node.LookupLE(key, tree.cmp)
+		switch node.Type() {
+		case bnode.BNODE_LEAF:
+			if node.CompareKey(idx, key, tree.cmp) != 0 {
+				return nil, false, nil
+			}
+			return tree.decodeVal(ptr, node.GetVal(idx)), true, nil
+		case bnode.BNODE_NODE:
+			// descend into the only kid whose range can contain the key
+			ptr = node.GetPtr(idx)
+			node = tree.node(ptr)
+		default:
+			panic("bad node!")
+		}
+	}
+}
@@ -1,21 +1,722 @@
 package btree
 
 import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"trees/pkg/btree/bnode"
+	"trees/pkg/btree/comparator"
+	"trees/pkg/btree/constant"
 	"trees/pkg/btree/pagemanager"
+	"trees/pkg/btree/storage"
+	"trees/pkg/btree/types"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
 )
 
 type C struct {
-	tree BTree
+	tree *BTree
 	ref  map[string]string // the reference data
 }
 
 func newC() *C {
-	pageManager := pagemanager.NewInMemory()
-	tree := BTree{
-		pageManager: pageManager,
+	return newCWithPageSize(constant.DEFAULT_PAGE_SIZE)
+}
+
+func newCWithPageSize(pageSize int) *C {
+	return newCWithOptions(Options{PageSize: pageSize})
+}
+
+func newCWithOptions(opts Options) *C {
+	if opts.PageSize == 0 {
+		opts.PageSize = constant.DEFAULT_PAGE_SIZE
 	}
 	return &C{
-		tree: tree,
+		tree: New(pagemanager.NewInMemory(opts.PageSize), opts),
 		ref:  map[string]string{},
 	}
 }
+
+// the trees of the tests are in memory, their updates never fail
+func noError(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (c *C) add(key string, val string) {
+	noError(c.tree.Insert([]byte(key), []byte(val)))
+	c.ref[key] = val
+}
+
+func get(t *testing.T, tree *BTree, key []byte) ([]byte, bool) {
+	t.Helper()
+	val, ok, err := tree.Get(key)
+	require.NoError(t, err)
+	return val, ok
+}
+
+// verify checks that every key of the reference data can be read back from the tree
+func (c *C) verify(t *testing.T) {
+	t.Helper()
+	for key, val := range c.ref {
+		got, ok := get(t, c.tree, []byte(key))
+		require.True(t, ok, "key %q not found", key)
+		require.Equal(t, val, string(got), "key %q", key)
+	}
+}
+
+func TestGet(t *testing.T) {
+	t.Run("empty tree", func(t *testing.T) {
+		c := newC()
+		_, ok := get(t, c.tree, []byte("missing"))
+		require.False(t, ok)
+		_, ok = get(t, c.tree, nil)
+		require.False(t, ok)
+	})
+
+	t.Run("single leaf", func(t *testing.T) {
+		c := newC()
+		for i := 0; i < 50; i++ {
+			c.add(fmt.Sprintf("key-%03d", i), fmt.Sprintf("val-%d", i))
+		}
+		c.verify(t)
+		_, ok := get(t, c.tree, []byte("key-"))
+		require.False(t, ok)
+		_, ok = get(t, c.tree, []byte("key-999"))
+		require.False(t, ok)
+		// the dummy key is never returned
+		_, ok = get(t, c.tree, []byte{})
+		require.False(t, ok)
+	})
+
+	t.Run("update", func(t *testing.T) {
+		c := newC()
+		c.add("a", "1")
+		c.add("b", "2")
+		c.add("a", "3")
+		c.verify(t)
+	})
+
+	t.Run("update with another size", func(t *testing.T) {
+		c := newC()
+		for i := 0; i < 20; i++ {
+			c.add(fmt.Sprintf("key-%02d", i), "val")
+		}
+		// the KVs after the updated one are shifted both ways
+		for _, val := range []string{"a much longer value", "", "v", strings.Repeat("x", 500), "val"} {
+			c.add("key-05", val)
+			c.add("key-00", val)
+			c.add("key-19", val)
+			c.verify(t)
+		}
+	})
+}
+
+func (c *C) del(key string) bool {
+	delete(c.ref, key)
+	deleted, err := c.tree.Delete([]byte(key))
+	noError(err)
+	return deleted
+}
+
+func TestDelete(t *testing.T) {
+	t.Run("empty tree", func(t *testing.T) {
+		c := newC()
+		require.False(t, c.del("missing"))
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		c := newC()
+		c.add("a", "1")
+		c.add("c", "3")
+		root := c.tree.RootPtr
+		require.False(t, c.del("b"))
+		require.False(t, c.del(""))
+		require.Equal(t, root, c.tree.RootPtr, "a failed delete must not touch the tree")
+		c.verify(t)
+	})
+
+	t.Run("single leaf", func(t *testing.T) {
+		c := newC()
+		for i := 0; i < 50; i++ {
+			c.add(fmt.Sprintf("key-%03d", i), fmt.Sprintf("val-%d", i))
+		}
+		for i := 0; i < 50; i += 2 {
+			require.True(t, c.del(fmt.Sprintf("key-%03d", i)))
+			require.False(t, c.del(fmt.Sprintf("key-%03d", i)))
+		}
+		c.verify(t)
+		for i := 0; i < 50; i += 2 {
+			_, ok := get(t, c.tree, []byte(fmt.Sprintf("key-%03d", i)))
+			require.False(t, ok)
+		}
+	})
+
+	t.Run("delete everything", func(t *testing.T) {
+		c := newC()
+		c.add("a", "1")
+		c.add("b", "2")
+		require.True(t, c.del("a"))
+		require.True(t, c.del("b"))
+		require.Zero(t, c.tree.RootPtr)
+		c.add("c", "3")
+		c.verify(t)
+	})
+}
+
+// verifyNodes walks the whole tree and checks the node sizes and the key order
+func (c *C) verifyNodes(t *testing.T) {
+	t.Helper()
+	if c.tree.RootPtr == constant.NilPagePtr {
+		require.Empty(t, c.ref)
+		return
+	}
+	var keys [][]byte
+	var walk func(ptr types.PagePtr)
+	walk = func(ptr types.PagePtr) {
+		node := bnode.BNode(c.tree.pageManager.Get(ptr))
+		require.LessOrEqual(t, node.NumBytes(), uint32(constant.NodeCapacity(c.tree.pageSize)))
+		for i := uint16(0); i < node.NumKeys(); i++ {
+			if node.Type() == bnode.BNODE_LEAF {
+				keys = append(keys, node.GetKey(i))
+				continue
+			}
+			kid := bnode.BNode(c.tree.pageManager.Get(node.GetPtr(i)))
+			require.Equal(t, node.GetKey(i), kid.GetKey(0), "the node key is a copy of the kid's first key")
+			walk(node.GetPtr(i))
+		}
+	}
+	walk(c.tree.RootPtr)
+	// the dummy key plus the reference data
+	require.Len(t, keys, len(c.ref)+1)
+	for i := 1; i < len(keys); i++ {
+		require.Negative(t, c.tree.Comparator().Compare(keys[i-1], keys[i]))
+	}
+}
+
+func TestErrors(t *testing.T) {
+	t.Run("rejected KVs", func(t *testing.T) {
+		c := newC()
+		c.add("a", "1")
+		root, pages := c.tree.RootPtr, c.tree.pageManager.(*pagemanager.InMemory).NumPages()
+		require.ErrorIs(t, c.tree.Insert(nil, []byte("x")), ErrEmptyKey)
+		err := c.tree.Insert([]byte(strings.Repeat("k", constant.BTREE_MAX_KEY_SIZE)), []byte("x"))
+		require.ErrorIs(t, err, ErrKeyTooLarge)
+		require.ErrorContains(t, err, "1000 bytes")
+		// the value is rejected before being read
+		huge := unsafe.Slice(&[]byte("x")[0], constant.BTREE_MAX_VAL_SIZE+1)
+		require.ErrorIs(t, c.tree.Insert([]byte("b"), huge), ErrValueTooLarge)
+		require.Equal(t, root, c.tree.RootPtr, "the tree is untouched")
+		require.Equal(t, pages, c.tree.pageManager.(*pagemanager.InMemory).NumPages())
+		c.add(strings.Repeat("k", constant.BTREE_MAX_KEY_SIZE-1), "max")
+		c.verify(t)
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		c := newC()
+		for i := 0; i < 1000; i++ {
+			c.add(fmt.Sprintf("key-%04d", i), fmt.Sprintf("val-%d", i))
+		}
+		c.add("big", strings.Repeat("big", 3000))
+		leaf := c.tree.node(c.tree.RootPtr)
+		for leaf.Type() == bnode.BNODE_NODE {
+			leaf = c.tree.node(leaf.GetPtr(leaf.LookupLE([]byte("big"), c.tree.cmp)))
+		}
+		_, overflow := decodeOverflowRef(constant.NilPagePtr, leaf.GetVal(leaf.LookupLE([]byte("big"), c.tree.cmp)))
+
+		// a pointer to a page of another kind, and a pointer to no page
+		root := c.tree.RootPtr
+		for _, bad := range []types.PagePtr{overflow, 12345} {
+			c.tree.RootPtr = bad
+			_, _, err := c.tree.Get([]byte("key-0001"))
+			var cerr *pagemanager.CorruptionError
+			require.ErrorAs(t, err, &cerr)
+			require.Equal(t, uint64(bad), cerr.Page)
+			require.ErrorIs(t, err, ErrCorruptPage)
+			require.ErrorIs(t, c.tree.Insert([]byte("key-0001"), []byte("x")), ErrCorruptPage)
+			_, err = c.tree.Delete([]byte("key-0001"))
+			require.ErrorIs(t, err, ErrCorruptPage)
+			require.Equal(t, bad, c.tree.RootPtr)
+		}
+		c.tree.RootPtr = root
+		c.verify(t)
+	})
+
+	t.Run("failed insert", func(t *testing.T) {
+		c := newC()
+		for i := 0; i < 1000; i++ {
+			c.add(fmt.Sprintf("key-%04d", i), fmt.Sprintf("val-%d", i))
+		}
+		// drop the leaf of key-0500 from the page manager
+		pages := c.tree.pageManager.(*pagemanager.InMemory)
+		node := c.tree.node(c.tree.RootPtr)
+		require.True(t, node.Type() == bnode.BNODE_NODE, "a root with kids")
+		ptr := node.GetPtr(node.LookupLE([]byte("key-0500"), c.tree.cmp))
+		leaf := c.tree.node(ptr)
+		pages.Del(ptr)
+
+		root, count := c.tree.RootPtr, pages.NumPages()
+		err := c.tree.Insert([]byte("key-0500"), []byte(strings.Repeat("big", 3000)))
+		require.ErrorIs(t, err, ErrCorruptPage)
+		require.Equal(t, root, c.tree.RootPtr)
+		require.Equal(t, count, pages.NumPages(), "the root is kept, the overflow pages are freed")
+		// the other leaves can still be read
+		val, ok := get(t, c.tree, []byte("key-0001"))
+		require.True(t, ok)
+		require.Equal(t, "val-1", string(val))
+
+		// the same page again
+		require.Equal(t, ptr, pages.New(leaf))
+		c.verify(t)
+		c.add("key-0500", "new")
+		c.verify(t)
+	})
+
+	t.Run("failed update of an overflow value", func(t *testing.T) {
+		c := newC()
+		for i := 0; i < 1000; i++ {
+			c.add(fmt.Sprintf("key-%04d", i), fmt.Sprintf("val-%d", i))
+		}
+		c.add("big", strings.Repeat("big", 3000))
+		// drop the 2nd page of its chain
+		pages := c.tree.pageManager.(*pagemanager.InMemory)
+		node := c.tree.node(c.tree.RootPtr)
+		for node.Type() == bnode.BNODE_NODE {
+			node = c.tree.node(node.GetPtr(node.LookupLE([]byte("big"), c.tree.cmp)))
+		}
+		_, first := decodeOverflowRef(constant.NilPagePtr, node.GetVal(node.LookupLE([]byte("big"), c.tree.cmp)))
+		ptr := c.tree.overflowPage(first).OverflowNext()
+		page := pages.Get(ptr)
+		pages.Del(ptr)
+
+		root, count := c.tree.RootPtr, pages.NumPages()
+		require.ErrorIs(t, c.tree.Insert([]byte("big"), []byte("small")), ErrCorruptPage)
+		_, err := c.tree.Delete([]byte("big"))
+		require.ErrorIs(t, err, ErrCorruptPage)
+		// the 1st page of the chain is still there
+		require.Equal(t, root, c.tree.RootPtr)
+		require.Equal(t, count, pages.NumPages())
+		require.Equal(t, ptr, pages.New(page))
+		c.verify(t)
+	})
+
+	t.Run("failed merge", func(t *testing.T) {
+		c := newC()
+		for i := 0; i < 200; i++ {
+			c.add(fmt.Sprintf("key-%04d", i), strings.Repeat("v", 300))
+		}
+		// drop the siblings of a leaf, the merge reads them
+		pages := c.tree.pageManager.(*pagemanager.InMemory)
+		root := c.tree.node(c.tree.RootPtr)
+		require.True(t, root.Type() == bnode.BNODE_NODE && root.NumKeys() > 3, "a root with kids")
+		idx := root.NumKeys() / 2
+		leaf := c.tree.node(root.GetPtr(idx))
+		siblings := map[types.PagePtr][]byte{}
+		for _, ptr := range []types.PagePtr{root.GetPtr(idx - 1), root.GetPtr(idx + 1)} {
+			siblings[ptr] = pages.Get(ptr)
+			pages.Del(ptr)
+		}
+
+		var err error
+		for i := uint16(1); i < leaf.NumKeys() && err == nil; i++ {
+			rootPtr, count := c.tree.RootPtr, pages.NumPages()
+			key := string(leaf.GetKey(i))
+			if _, err = c.tree.Delete([]byte(key)); err == nil {
+				delete(c.ref, key)
+				continue
+			}
+			require.ErrorIs(t, err, ErrCorruptPage)
+			require.Equal(t, rootPtr, c.tree.RootPtr)
+			require.Equal(t, count, pages.NumPages(), "the kid is kept")
+		}
+		require.Error(t, err, "the leaf became small enough to be merged")
+		for ptr, page := range siblings {
+			require.Equal(t, ptr, pages.New(page))
+		}
+		c.verify(t)
+	})
+}
+
+func TestInsertDeleteLarge(t *testing.T) {
+	for _, pageSize := range []int{constant.MIN_PAGE_SIZE, 8192, 16384, constant.MAX_PAGE_SIZE} {
+		t.Run(fmt.Sprintf("page%d", pageSize), func(t *testing.T) {
+			c := newCWithPageSize(pageSize)
+			rng := rand.New(rand.NewSource(1))
+			perm := rng.Perm(5000)
+			for _, i := range perm {
+				// values of various sizes to get leaves with various fill levels
+				c.add(fmt.Sprintf("key-%05d", i), strings.Repeat("v", rng.Intn(200)))
+			}
+			c.verify(t)
+			c.verifyNodes(t)
+
+			// large keys and values
+			bigVal := strings.Repeat("v", c.tree.maxInlineValSize())
+			for i := 0; i < 50; i++ {
+				c.add(fmt.Sprintf("big-%02d-%s", i, strings.Repeat("k", 900)), bigVal)
+			}
+			c.verify(t)
+			c.verifyNodes(t)
+
+			for n, i := range rng.Perm(5000) {
+				require.True(t, c.del(fmt.Sprintf("key-%05d", i)))
+				if n%1000 == 0 {
+					c.verify(t)
+					c.verifyNodes(t)
+				}
+			}
+			for i := 0; i < 50; i++ {
+				require.True(t, c.del(fmt.Sprintf("big-%02d-%s", i, strings.Repeat("k", 900))))
+			}
+			c.verifyNodes(t)
+			require.Zero(t, c.tree.RootPtr)
+		})
+	}
+}
+
+// TestDeleteKeySizes mixes short and near max keys: a deletion can give a kid a longer first key,
+// then its parent no longer fits in a page, and must be split like by an insertion.
+func TestDeleteKeySizes(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%v", compress), func(t *testing.T) {
+			c := newCWithOptions(Options{PrefixCompression: compress})
+			rng := rand.New(rand.NewSource(0))
+			key := func() string {
+				key := fmt.Sprintf("%04d", rng.Intn(2000))
+				if rng.Intn(2) == 0 {
+					key += strings.Repeat("x", 990)
+				}
+				return key
+			}
+			for i := 0; i < 20000; i++ {
+				if rng.Intn(3) == 0 {
+					c.del(key())
+				} else {
+					c.add(key(), "val")
+				}
+				if i%2000 == 0 {
+					c.verify(t)
+					c.verifyNodes(t)
+				}
+			}
+			for key := range c.ref {
+				require.True(t, c.del(key))
+			}
+			c.verifyNodes(t)
+			require.Zero(t, c.tree.RootPtr)
+		})
+	}
+}
+
+// the tree runs unchanged over the pages of a file
+func TestOnDisk(t *testing.T) {
+	pages, err := pagemanager.NewOnDisk(storage.NewMemFile(), constant.DEFAULT_PAGE_SIZE, 1)
+	require.NoError(t, err)
+	defer pages.Close()
+	c := &C{tree: New(pages, Options{PageSize: constant.DEFAULT_PAGE_SIZE}), ref: map[string]string{}}
+	rng := rand.New(rand.NewSource(1))
+	for n, i := range rng.Perm(3000) {
+		// some overflow values
+		c.add(fmt.Sprintf("key-%05d", i), strings.Repeat("v", rng.Intn(2*c.tree.maxInlineValSize())))
+		if n%500 == 0 {
+			require.NoError(t, pages.Flush())
+		}
+	}
+	c.verify(t)
+	c.verifyNodes(t)
+
+	// a reader sees the flushed pages only
+	require.NoError(t, pages.Flush())
+	require.Zero(t, pages.Pending())
+	reader := New(pages.Reader(), Options{PageSize: constant.DEFAULT_PAGE_SIZE})
+	reader.RootPtr = c.tree.RootPtr
+	for key, val := range c.ref {
+		got, ok := get(t, reader, []byte(key))
+		require.True(t, ok)
+		require.Equal(t, val, string(got))
+	}
+	for i := 0; i < 3000; i += 2 {
+		require.True(t, c.del(fmt.Sprintf("key-%05d", i)))
+	}
+	c.verify(t)
+	c.verifyNodes(t)
+}
+
+// the tree runs unchanged through a cache of its internal nodes
+func TestCache(t *testing.T) {
+	cache := pagemanager.NewCache(pagemanager.NewInMemory(constant.DEFAULT_PAGE_SIZE), 4*constant.DEFAULT_PAGE_SIZE)
+	c := &C{tree: New(cache, Options{}), ref: map[string]string{}}
+	rng := rand.New(rand.NewSource(1))
+	// long keys, for more internal nodes than the cache can hold
+	key := func(i int) string { return fmt.Sprintf("key-%05d-%s", i, strings.Repeat("k", 100)) }
+	for _, i := range rng.Perm(5000) {
+		c.add(key(i), strings.Repeat("v", rng.Intn(200)))
+	}
+	c.verify(t)
+	for i := 0; i < 5000; i += 2 {
+		require.True(t, c.del(key(i)))
+	}
+	c.verify(t)
+	c.verifyNodes(t)
+	stats := cache.Stats()
+	require.NotZero(t, stats.Hits)
+	require.NotZero(t, stats.Evictions)
+	require.LessOrEqual(t, stats.Bytes, 4*constant.DEFAULT_PAGE_SIZE)
+}
+
+func TestUpdateValueSize(t *testing.T) {
+	c := newC()
+	for i := 0; i < 20; i++ {
+		c.add(fmt.Sprintf("key-%02d", i), "short")
+	}
+	// growing and shrinking a value in the middle of a leaf shifts the following KVs
+	c.add("key-05", strings.Repeat("long", 100))
+	c.verify(t)
+	c.add("key-05", "")
+	c.verify(t)
+	c.verifyNodes(t)
+}
+
+func TestOverflowValues(t *testing.T) {
+	c := newC()
+	pageManager := c.tree.pageManager.(*pagemanager.InMemory)
+	capacity := bnode.OverflowCapacity(c.tree.pageSize)
+
+	sizes := []int{
+		c.tree.maxInlineValSize(),
+		c.tree.maxInlineValSize() + 1,
+		capacity,
+		capacity + 1,
+		10 * capacity,
+		1 << 20,
+	}
+	for i, size := range sizes {
+		c.add(fmt.Sprintf("key-%02d", i), strings.Repeat(string(rune('a'+i)), size))
+	}
+	// small values around the big ones
+	for i := 0; i < 100; i++ {
+		c.add(fmt.Sprintf("small-%03d", i), fmt.Sprintf("val-%d", i))
+	}
+	c.verify(t)
+	c.verifyNodes(t)
+
+	t.Run("cursor", func(t *testing.T) {
+		cur := c.tree.Cursor()
+		cur.Seek([]byte("key-05"))
+		require.Equal(t, c.ref["key-05"], string(cur.Value()))
+	})
+
+	t.Run("update frees the old chain", func(t *testing.T) {
+		before := pageManager.NumPages()
+		c.add("key-04", strings.Repeat("z", 10*capacity))
+		require.Equal(t, before, pageManager.NumPages())
+		c.add("key-04", "inline now")
+		require.Equal(t, before-10, pageManager.NumPages())
+		c.add("key-04", strings.Repeat("y", 3*capacity))
+		require.Equal(t, before-7, pageManager.NumPages())
+		c.verify(t)
+	})
+
+	t.Run("delete frees the chain", func(t *testing.T) {
+		for key := range c.ref {
+			require.True(t, c.del(key))
+		}
+		require.Zero(t, c.tree.RootPtr)
+		require.Zero(t, pageManager.NumPages())
+	})
+}
+
+func TestOverflowCorrupted(t *testing.T) {
+	c := newC()
+	for i := 0; i < 100; i++ {
+		c.add(fmt.Sprintf("key-%02d", i), fmt.Sprintf("val-%d", i))
+	}
+	c.add("big", strings.Repeat("big", 3000))
+	pages := c.tree.pageManager.(*pagemanager.InMemory)
+	node := c.tree.node(c.tree.RootPtr)
+	for node.Type() == bnode.BNODE_NODE {
+		node = c.tree.node(node.GetPtr(node.LookupLE([]byte("big"), c.tree.cmp)))
+	}
+	stored := node.GetVal(node.LookupLE([]byte("big"), c.tree.cmp))
+	_, first := decodeOverflowRef(constant.NilPagePtr, stored)
+	last := first
+	for c.tree.overflowPage(last).OverflowNext() != constant.NilPagePtr {
+		last = c.tree.overflowPage(last).OverflowNext()
+	}
+	requireCorrupted := func(t *testing.T) {
+		t.Helper()
+		root, count := c.tree.RootPtr, pages.NumPages()
+		_, _, err := c.tree.Get([]byte("big"))
+		require.ErrorIs(t, err, ErrCorruptPage)
+		require.ErrorIs(t, c.tree.Insert([]byte("big"), []byte("small")), ErrCorruptPage)
+		_, err = c.tree.Delete([]byte("big"))
+		require.ErrorIs(t, err, ErrCorruptPage)
+		require.Equal(t, root, c.tree.RootPtr)
+		require.Equal(t, count, pages.NumPages())
+	}
+
+	t.Run("cycle", func(t *testing.T) {
+		// the last page of the chain leads back to the first one
+		next := bnode.BNode(pages.Get(last))[constant.HEADER_SIZE:]
+		binary.LittleEndian.PutUint64(next, uint64(first))
+		requireCorrupted(t)
+		binary.LittleEndian.PutUint64(next, uint64(constant.NilPagePtr))
+		c.verify(t)
+	})
+
+	t.Run("size", func(t *testing.T) {
+		// a chain longer than the value, then shorter
+		for _, size := range []uint64{8000, 12000} {
+			binary.LittleEndian.PutUint64(stored[1:], size)
+			requireCorrupted(t)
+		}
+		binary.LittleEndian.PutUint64(stored[1:], 9000)
+		c.verify(t)
+	})
+
+	t.Run("tag", func(t *testing.T) {
+		stored[0] = 7
+		requireCorrupted(t)
+		stored[0] = valOverflow
+		c.verify(t)
+	})
+}
+
+func TestPrefixCompression(t *testing.T) {
+	key := func(i int) string { return fmt.Sprintf("tenant/123/object/%06d", i) }
+	fill := func(c *C) {
+		for _, i := range rand.New(rand.NewSource(1)).Perm(8000) {
+			c.add(key(i), fmt.Sprintf("val-%d", i))
+		}
+	}
+
+	plain := newC()
+	fill(plain)
+	c := newC()
+	c.tree.compress = true
+	fill(c)
+	c.verify(t)
+	c.verifyNodes(t)
+
+	plainPages := plain.tree.pageManager.(*pagemanager.InMemory).NumPages()
+	pages := c.tree.pageManager.(*pagemanager.InMemory).NumPages()
+	require.Less(t, pages, plainPages*3/4, "compressed nodes should hold more entries")
+
+	cur := c.tree.Cursor()
+	cur.Seek([]byte(key(1234)))
+	require.Equal(t, key(1234), string(cur.Key()))
+	cur.Prev()
+	require.Equal(t, key(1233), string(cur.Key()))
+
+	// a key that doesn't share the prefix ends up at the edge of the nodes
+	c.add("tenant/124", "other")
+	c.add("tenant/122", "other")
+	c.verify(t)
+	c.verifyNodes(t)
+
+	for n, i := range rand.New(rand.NewSource(2)).Perm(8000) {
+		require.True(t, c.del(key(i)))
+		if n%2000 == 0 {
+			c.verify(t)
+			c.verifyNodes(t)
+		}
+	}
+	c.verify(t)
+	c.verifyNodes(t)
+
+	t.Run("turned on for an existing tree", func(t *testing.T) {
+		plain.tree.compress = true
+		for i := 0; i < 8000; i += 3 {
+			require.True(t, plain.del(key(i)))
+		}
+		for i := 8000; i < 10000; i++ {
+			plain.add(key(i), "new")
+		}
+		plain.verify(t)
+		plain.verifyNodes(t)
+	})
+}
+
+func TestComparator(t *testing.T) {
+	for _, tc := range []struct {
+		cmp      *comparator.Comparator
+		compress bool
+	}{
+		{comparator.Reverse, false},
+		{comparator.Reverse, true},
+		{comparator.CaseInsensitive, false},
+	} {
+		t.Run(fmt.Sprintf("%s/compress=%v", tc.cmp.Name, tc.compress), func(t *testing.T) {
+			c := newCWithOptions(Options{Comparator: tc.cmp, PrefixCompression: tc.compress})
+			for _, i := range rand.New(rand.NewSource(1)).Perm(5000) {
+				c.add(fmt.Sprintf("key-%05d", i), fmt.Sprintf("val-%d", i))
+			}
+			c.verify(t)
+			c.verifyNodes(t)
+
+			var got []string
+			c.tree.Scan(nil, nil, func(key []byte, val []byte) bool {
+				got = append(got, string(key))
+				return true
+			})
+			require.Equal(t, c.sortedKeys(), got)
+
+			for i := 0; i < 5000; i += 2 {
+				require.True(t, c.del(fmt.Sprintf("key-%05d", i)))
+			}
+			c.verify(t)
+			c.verifyNodes(t)
+		})
+	}
+
+	t.Run("reverse order", func(t *testing.T) {
+		c := newCWithOptions(Options{Comparator: comparator.Reverse})
+		for _, key := range []string{"a", "ab", "b", "ba", "c"} {
+			c.add(key, key)
+		}
+		var got []string
+		c.tree.ScanPrefix([]byte("a"), func(key []byte, val []byte) bool {
+			got = append(got, string(key))
+			return true
+		})
+		require.Equal(t, []string{"ab", "a"}, got)
+
+		cur := c.tree.Cursor()
+		cur.First()
+		require.Equal(t, "c", string(cur.Key()))
+		cur.Seek([]byte("bb"))
+		require.Equal(t, "ba", string(cur.Key()))
+	})
+
+	t.Run("case insensitive", func(t *testing.T) {
+		c := newCWithOptions(Options{Comparator: comparator.CaseInsensitive})
+		require.NoError(t, c.tree.Insert([]byte("Hello"), []byte("1")))
+		require.NoError(t, c.tree.Insert([]byte("aa"), []byte("2")))
+		require.NoError(t, c.tree.Insert([]byte("AB"), []byte("3")))
+		require.NoError(t, c.tree.Insert([]byte("ac"), []byte("4")))
+		val, ok := get(t, c.tree, []byte("HELLO"))
+		require.True(t, ok)
+		require.Equal(t, "1", string(val))
+		require.NoError(t, c.tree.Insert([]byte("hello"), []byte("5")))
+		val, _ = get(t, c.tree, []byte("Hello"))
+		require.Equal(t, "5", string(val), "keys differing by their case are the same key")
+
+		var got []string
+		c.tree.ScanPrefix([]byte("a"), func(key []byte, val []byte) bool {
+			got = append(got, string(key))
+			return true
+		})
+		require.Equal(t, []string{"aa", "ac"}, got)
+	})
+
+	t.Run("prefix compression needs a prefix contiguous order", func(t *testing.T) {
+		require.Panics(t, func() {
+			New(pagemanager.NewInMemory(constant.DEFAULT_PAGE_SIZE),
+				Options{Comparator: comparator.CaseInsensitive, PrefixCompression: true})
+		})
+	})
+}
@@ -0,0 +1,144 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"trees/internal/errors"
+	"trees/pkg/btree/bnode"
+	"trees/pkg/btree/constant"
+	"trees/pkg/btree/types"
+)
+
+// Builder bulk loads an empty tree from KVs added in increasing key order.
+// The tree is built bottom-up: leaves are filled up to the fill factor and allocated
+// as soon as they are full, and each allocated node adds a key to its parent level.
+// This avoids the copy-on-write path rewrite that BTree.Insert does for each key.
+type Builder struct {
+	tree *BTree
+	// max size of the built nodes in bytes
+	maxBytes uint32
+	// the nodes being filled, from the leaves to the top level
+	levels []*buildLevel
+	// the last added key, to check the order
+	lastKey []byte
+	// Finish was called
+	done bool
+}
+
+// the entries of the node being filled at one level of the tree
+type buildLevel struct {
+	ptrs    []types.PagePtr
+	keys    [][]byte
+	vals    [][]byte
+	kvBytes uint32 // full size of the KVs
+	// number of nodes already allocated at this level
+	nallocated int
+}
+
+// NewBuilder creates a builder for the empty tree.
+// fillFactor is the fraction of each page filled by the built nodes, in (0, 1].
+// a fill factor below 1 leaves room for later insertions without splitting every node.
+func NewBuilder(tree *BTree, fillFactor float64) (*Builder, error) {
+	if tree.RootPtr != constant.NilPagePtr {
+		return nil, fmt.Errorf("bulk loading into a non empty tree")
+	}
+	if fillFactor <= 0 || fillFactor > 1 {
+		return nil, fmt.Errorf("bad fill factor %v, it must be in (0, 1]", fillFactor)
+	}
+	b := &Builder{
+		tree:     tree,
+		maxBytes: uint32(fillFactor * float64(constant.NodeCapacity(tree.pageSize))),
+	}
+	// the dummy key of the leftmost nodes, it covers the whole key space
+	b.levels = append(b.levels, &buildLevel{})
+	b.push(0, constant.NilPagePtr, nil, nil)
+	return b, nil
+}
+
+// Add adds a KV to the tree. keys must be strictly increasing in the order of the tree.
+func (b *Builder) Add(key []byte, val []byte) error {
+	if b.done {
+		return fmt.Errorf("the builder is finished")
+	}
+	if err := checkKV(key, val); err != nil {
+		return err
+	}
+	if b.lastKey != nil && b.tree.Comparator().Compare(b.lastKey, key) >= 0 {
+		return fmt.Errorf("key %q is not greater than the previous key %q", key, b.lastKey)
+	}
+	b.lastKey = append(b.lastKey[:0], key...)
+	b.push(0, constant.NilPagePtr, bytes.Clone(key), b.tree.encodeVal(val, b.tree.pageManager.New))
+	return nil
+}
+
+// size of the node holding the entries of the level, plus an extra KV of kvBytes
+func (b *Builder) nodeBytes(lvl *buildLevel, key []byte, kvBytes uint32) uint32 {
+	nkeys := uint16(len(lvl.keys) + 1)
+	kvBytes += lvl.kvBytes
+	size := bnode.NodeBytes(nkeys, kvBytes, 0)
+	if b.tree.compress {
+		plen := bnode.CommonPrefixLen(lvl.keys[0], key)
+		size = min(size, bnode.NodeBytes(nkeys, kvBytes, plen))
+	}
+	return size
+}
+
+// add an entry to the node being filled at a level,
+// allocating that node first if the entry doesn't fit in it.
+func (b *Builder) push(level int, ptr types.PagePtr, key []byte, val []byte) {
+	lvl := b.levels[level]
+	kvBytes := uint32(4 + len(key) + len(val))
+	if len(lvl.keys) > 0 && b.nodeBytes(lvl, key, kvBytes) > b.maxBytes {
+		b.flush(level)
+	}
+	lvl.ptrs = append(lvl.ptrs, ptr)
+	lvl.keys = append(lvl.keys, key)
+	lvl.vals = append(lvl.vals, val)
+	lvl.kvBytes += kvBytes
+}
+
+// allocate the node being filled at a level, and add it to the parent level
+func (b *Builder) flush(level int) {
+	lvl := b.levels[level]
+	ptr := b.tree.pageManager.New(b.node(level))
+	lvl.nallocated++
+	firstKey := lvl.keys[0]
+	lvl.ptrs, lvl.keys, lvl.vals, lvl.kvBytes = lvl.ptrs[:0], lvl.keys[:0], lvl.vals[:0], 0
+	if level+1 == len(b.levels) {
+		b.levels = append(b.levels, &buildLevel{})
+	}
+	b.push(level+1, ptr, firstKey, nil)
+}
+
+// build the node holding the entries of a level
+func (b *Builder) node(level int) bnode.BNode {
+	lvl := b.levels[level]
+	btype := uint16(bnode.BNODE_NODE)
+	if level == 0 {
+		btype = bnode.BNODE_LEAF
+	}
+	node := make(bnode.BNode, max(bnode.NodeBytes(uint16(len(lvl.keys)), lvl.kvBytes, 0), uint32(b.tree.pageSize)))
+	node.SetHeader(btype, uint16(len(lvl.keys)))
+	for i := range lvl.keys {
+		node.CopyPtrAndKV(uint16(i), lvl.ptrs[i], lvl.keys[i], lvl.vals[i])
+	}
+	return node.Fit(b.tree.pageSize, b.tree.compress)
+}
+
+// Finish allocates the remaining nodes and sets the root of the tree.
+func (b *Builder) Finish() {
+	errors.Assert(!b.done, "the builder is already finished")
+	b.done = true
+	if b.lastKey == nil {
+		return // only the dummy key, the tree stays empty
+	}
+	for level := 0; ; level++ {
+		lvl := b.levels[level]
+		if level+1 == len(b.levels) && lvl.nallocated == 0 {
+			// the only node of the top level is the root
+			b.tree.RootPtr = b.tree.pageManager.New(b.node(level))
+			return
+		}
+		b.flush(level)
+	}
+}
@@ -0,0 +1,99 @@
+package btree
+
+import (
+	"fmt"
+	"testing"
+	"trees/pkg/btree/pagemanager"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuilder(t *testing.T) {
+	key := func(i int) string { return fmt.Sprintf("key-%06d", i) }
+	for _, n := range []int{0, 1, 10, 5000} {
+		for _, fillFactor := range []float64{0.5, 0.9, 1} {
+			for _, compress := range []bool{false, true} {
+				t.Run(fmt.Sprintf("n%d/fill%v/compress=%v", n, fillFactor, compress), func(t *testing.T) {
+					c := newC()
+					c.tree.compress = compress
+					b, err := NewBuilder(c.tree, fillFactor)
+					require.NoError(t, err)
+					for i := 0; i < n; i++ {
+						val := fmt.Sprintf("val-%d", i)
+						require.NoError(t, b.Add([]byte(key(i)), []byte(val)))
+						c.ref[key(i)] = val
+					}
+					b.Finish()
+					c.verify(t)
+					c.verifyNodes(t)
+
+					got := []string{}
+					c.tree.Scan(nil, nil, func(key, val []byte) bool {
+						got = append(got, string(key))
+						return true
+					})
+					require.Equal(t, c.sortedKeys(), got)
+
+					// the tree can be updated normally afterwards
+					for i := 0; i < n; i += 3 {
+						require.True(t, c.del(key(i)))
+					}
+					c.add(key(n), "last")
+					c.add("a", "first")
+					c.verify(t)
+					c.verifyNodes(t)
+				})
+			}
+		}
+	}
+}
+
+func TestBuilderPageUsage(t *testing.T) {
+	build := func(fillFactor float64) int {
+		c := newC()
+		b, err := NewBuilder(c.tree, fillFactor)
+		require.NoError(t, err)
+		for i := 0; i < 10000; i++ {
+			require.NoError(t, b.Add([]byte(fmt.Sprintf("key-%06d", i)), []byte("val")))
+		}
+		b.Finish()
+		return c.tree.pageManager.(*pagemanager.InMemory).NumPages()
+	}
+	full, half := build(1), build(0.5)
+	require.Less(t, full, half)
+	require.InDelta(t, 2*full, half, float64(full)/5)
+}
+
+func TestBuilderErrors(t *testing.T) {
+	c := newC()
+	_, err := NewBuilder(c.tree, 0)
+	require.Error(t, err)
+	_, err = NewBuilder(c.tree, 1.5)
+	require.Error(t, err)
+
+	b, err := NewBuilder(c.tree, 1)
+	require.NoError(t, err)
+	require.Error(t, b.Add(nil, []byte("val")))
+	require.NoError(t, b.Add([]byte("b"), []byte("val")))
+	require.Error(t, b.Add([]byte("b"), []byte("val")), "duplicate key")
+	require.Error(t, b.Add([]byte("a"), []byte("val")), "unsorted key")
+	b.Finish()
+	require.Error(t, b.Add([]byte("c"), []byte("val")))
+
+	_, err = NewBuilder(c.tree, 1)
+	require.Error(t, err, "the tree is not empty anymore")
+}
+
+func TestBuilderLargeValues(t *testing.T) {
+	c := newC()
+	b, err := NewBuilder(c.tree, 1)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		val := string(make([]byte, i*200))
+		require.NoError(t, b.Add([]byte(fmt.Sprintf("key-%03d", i)), []byte(val)))
+		c.ref[fmt.Sprintf("key-%03d", i)] = val
+	}
+	b.Finish()
+	c.verify(t)
+	c.verifyNodes(t)
+}
@@ -0,0 +1,302 @@
+// Package codec encodes tuples into keys whose byte order is the order of the tuples,
+// so that a BTree sorting its keys with bytes.Compare iterates them in logical order.
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// TUPLE ENCODING
+// a tuple is the concatenation of its elements, each one a type tag followed by its value:
+//   - an int64 is big endian with the sign bit flipped, so that the negative values come first.
+//   - a uint64 is big endian.
+//   - a float64 is its IEEE 754 bits, big endian, with the sign bit flipped for the positive values
+//     and all the bits flipped for the negative ones. -0 sorts before +0. the NaNs are all encoded
+//     as math.NaN(), whatever their sign and payload, so that they sort after +Inf.
+//   - a string or a []byte ends with a 0x00, and its 0x00 and 0x01 are escaped as 0x01 0x01 and 0x01 0x02,
+//     so that a value sorts before the values it's a prefix of.
+//
+// the tuples compare element by element, and a tuple sorts before the tuples it's a prefix of.
+// the elements of different types at the same position compare by their tags.
+const (
+	TagBytes   = 0x01
+	TagString  = 0x02
+	TagInt64   = 0x03
+	TagUint64  = 0x04
+	TagFloat64 = 0x05
+)
+
+// ErrMalformed is returned when decoding bytes which are not an encoded tuple
+var ErrMalformed = errors.New("malformed tuple")
+
+// Encode returns the encoding of a tuple, see Append.
+func Encode(elems ...any) []byte {
+	return Append(nil, elems...)
+}
+
+// Append appends the encoding of a tuple to dst.
+// the elements are ints, uints, floats, strings and []byte, of any size: they are encoded as
+// int64, uint64, float64, string and []byte elements. it panics on the elements of other types.
+func Append(dst []byte, elems ...any) []byte {
+	for _, elem := range elems {
+		switch v := elem.(type) {
+		case int:
+			dst = AppendInt64(dst, int64(v))
+		case int8:
+			dst = AppendInt64(dst, int64(v))
+		case int16:
+			dst = AppendInt64(dst, int64(v))
+		case int32:
+			dst = AppendInt64(dst, int64(v))
+		case int64:
+			dst = AppendInt64(dst, v)
+		case uint:
+			dst = AppendUint64(dst, uint64(v))
+		case uint8:
+			dst = AppendUint64(dst, uint64(v))
+		case uint16:
+			dst = AppendUint64(dst, uint64(v))
+		case uint32:
+			dst = AppendUint64(dst, uint64(v))
+		case uint64:
+			dst = AppendUint64(dst, v)
+		case float32:
+			dst = AppendFloat64(dst, float64(v))
+		case float64:
+			dst = AppendFloat64(dst, v)
+		case string:
+			dst = AppendString(dst, v)
+		case []byte:
+			dst = AppendBytes(dst, v)
+		default:
+			panic(fmt.Sprintf("codec: can't encode a tuple element of type %T", elem))
+		}
+	}
+	return dst
+}
+
+func AppendInt64(dst []byte, v int64) []byte {
+	dst = append(dst, TagInt64)
+	return binary.BigEndian.AppendUint64(dst, uint64(v)^(1<<63))
+}
+
+func AppendUint64(dst []byte, v uint64) []byte {
+	dst = append(dst, TagUint64)
+	return binary.BigEndian.AppendUint64(dst, v)
+}
+
+func AppendFloat64(dst []byte, v float64) []byte {
+	if math.IsNaN(v) {
+		v = math.NaN()
+	}
+	bits := math.Float64bits(v)
+	if bits>>63 == 1 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	dst = append(dst, TagFloat64)
+	return binary.BigEndian.AppendUint64(dst, bits)
+}
+
+func AppendString(dst []byte, v string) []byte {
+	return appendEscaped(append(dst, TagString), v)
+}
+
+func AppendBytes(dst []byte, v []byte) []byte {
+	return appendEscaped(append(dst, TagBytes), v)
+}
+
+func appendEscaped[T string | []byte](dst []byte, v T) []byte {
+	for i := 0; i < len(v); i++ {
+		if b := v[i]; b <= 0x01 {
+			dst = append(dst, 0x01, b+1)
+		} else {
+			dst = append(dst, b)
+		}
+	}
+	return append(dst, 0x00)
+}
+
+// Decode returns the elements of an encoded tuple, as int64, uint64, float64, string and []byte.
+func Decode(data []byte) ([]any, error) {
+	var elems []any
+	d := NewDecoder(data)
+	for d.More() {
+		elems = append(elems, d.Next())
+	}
+	return elems, d.Err()
+}
+
+// Decoder reads the elements of an encoded tuple one by one.
+// after an error, the reads return zero values, and Err returns the error.
+type Decoder struct {
+	data []byte
+	err  error
+}
+
+func NewDecoder(data []byte) *Decoder {
+	return &Decoder{data: data}
+}
+
+// More reports whether there are elements left to read
+func (d *Decoder) More() bool {
+	return d.err == nil && len(d.data) > 0
+}
+
+// Rest returns the bytes after the elements read so far
+func (d *Decoder) Rest() []byte {
+	return d.data
+}
+
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+func (d *Decoder) fail(format string, args ...any) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: %s", ErrMalformed, fmt.Sprintf(format, args...))
+	}
+	d.data = nil
+}
+
+// tag reads the tag of the next element, which must be want
+func (d *Decoder) tag(want byte) bool {
+	switch {
+	case d.err != nil:
+		return false
+	case len(d.data) == 0:
+		d.fail("no element left")
+		return false
+	case d.data[0] != want:
+		d.fail("the element has the tag %#x, not %#x", d.data[0], want)
+		return false
+	}
+	d.data = d.data[1:]
+	return true
+}
+
+func (d *Decoder) fixed() uint64 {
+	if len(d.data) < 8 {
+		d.fail("truncated element")
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.data)
+	d.data = d.data[8:]
+	return v
+}
+
+func (d *Decoder) escaped() []byte {
+	var out []byte
+	for i := 0; i < len(d.data); i++ {
+		switch b := d.data[i]; b {
+		case 0x00:
+			d.data = d.data[i+1:]
+			if out == nil {
+				out = []byte{}
+			}
+			return out
+		case 0x01:
+			if i+1 == len(d.data) || d.data[i+1] > 0x02 || d.data[i+1] == 0 {
+				d.fail("bad escape")
+				return nil
+			}
+			i++
+			out = append(out, d.data[i]-1)
+		default:
+			out = append(out, b)
+		}
+	}
+	d.fail("truncated element")
+	return nil
+}
+
+func (d *Decoder) ReadInt64() int64 {
+	if !d.tag(TagInt64) {
+		return 0
+	}
+	return int64(d.fixed() ^ (1 << 63))
+}
+
+func (d *Decoder) ReadUint64() uint64 {
+	if !d.tag(TagUint64) {
+		return 0
+	}
+	return d.fixed()
+}
+
+func (d *Decoder) ReadFloat64() float64 {
+	if !d.tag(TagFloat64) {
+		return 0
+	}
+	bits := d.fixed()
+	if bits>>63 == 1 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits)
+}
+
+func (d *Decoder) ReadString() string {
+	if !d.tag(TagString) {
+		return ""
+	}
+	return string(d.escaped())
+}
+
+// ReadBytes returns a copy of the next element, which is a []byte
+func (d *Decoder) ReadBytes() []byte {
+	if !d.tag(TagBytes) {
+		return nil
+	}
+	return d.escaped()
+}
+
+// Next reads the next element whatever its type
+func (d *Decoder) Next() any {
+	if !d.More() {
+		d.fail("no element left")
+		return nil
+	}
+	switch d.data[0] {
+	case TagInt64:
+		return d.ReadInt64()
+	case TagUint64:
+		return d.ReadUint64()
+	case TagFloat64:
+		return d.ReadFloat64()
+	case TagString:
+		return d.ReadString()
+	case TagBytes:
+		return d.ReadBytes()
+	default:
+		d.fail("unknown tag %#x", d.data[0])
+		return nil
+	}
+}
+
+// PrefixRange returns the range of the keys starting with the tuple elems,
+// i.e. the tuples which extend it, for btree.BTree.Scan: start <= key < end.
+// end is nil when there is no upper bound.
+func PrefixRange(elems ...any) (start []byte, end []byte) {
+	start = Encode(elems...)
+	return start, PrefixEnd(start)
+}
+
+// PrefixEnd returns the smallest key that is greater than every key starting with prefix,
+// or nil if there is no such key (the prefix is empty or made only of 0xff bytes).
+func PrefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] != 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package codec
+
+import (
+	"bytes"
+	"cmp"
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// compareTuples compares two tuples whose elements at the same position have the same type
+func compareTuples(a, b []any) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		var c int
+		switch x := a[i].(type) {
+		case int64:
+			c = cmp.Compare(x, b[i].(int64))
+		case uint64:
+			c = cmp.Compare(x, b[i].(uint64))
+		case float64:
+			y := b[i].(float64)
+			c = cmp.Compare(x, y)
+			if c == 0 && x == 0 {
+				c = cmp.Compare(1/x, 1/y) // -0 < +0
+			}
+		case string:
+			c = cmp.Compare(x, b[i].(string))
+		case []byte:
+			c = bytes.Compare(x, b[i].([]byte))
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+var (
+	ints   = []int64{math.MinInt64, -1 << 40, -256, -1, 0, 1, 255, 256, 1 << 40, math.MaxInt64}
+	uints  = []uint64{0, 1, 255, 256, 1 << 40, 1 << 63, math.MaxUint64}
+	floats = []float64{math.Inf(-1), -math.MaxFloat64, -1.5, -math.SmallestNonzeroFloat64, math.Copysign(0, -1), 0, math.SmallestNonzeroFloat64, 0.1, 1, 1e300, math.Inf(1)}
+	strs   = []string{"", "\x00", "\x00\x00", "\x00\x01", "\x01", "\x01\x00", "\x02", "a", "a\x00", "a\x00b", "a\x01", "ab", "b", "\xff"}
+)
+
+// randomTuple returns a tuple of the schema (int64, string, uint64, []byte, float64), or a prefix of it
+func randomTuple(rng *rand.Rand) []any {
+	tuple := []any{
+		ints[rng.Intn(len(ints))],
+		strs[rng.Intn(len(strs))],
+		uints[rng.Intn(len(uints))],
+		[]byte(strs[rng.Intn(len(strs))]),
+		floats[rng.Intn(len(floats))],
+	}
+	return tuple[:1+rng.Intn(len(tuple))]
+}
+
+func TestOrder(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	tuples := map[string][]any{}
+	for i := 0; i < 5000; i++ {
+		tuple := randomTuple(rng)
+		tuples[string(Encode(tuple...))] = tuple
+	}
+	keys := make([]string, 0, len(tuples))
+	for key := range tuples {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for i := 1; i < len(keys); i++ {
+		require.Equal(t, -1, compareTuples(tuples[keys[i-1]], tuples[keys[i]]), "%v < %v", tuples[keys[i-1]], tuples[keys[i]])
+	}
+}
+
+func TestDecode(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		tuple := randomTuple(rng)
+		elems, err := Decode(Encode(tuple...))
+		require.NoError(t, err)
+		require.Len(t, elems, len(tuple))
+		require.Zero(t, compareTuples(tuple, elems), "%v", tuple)
+	}
+
+	// the sizes are widened
+	elems, err := Decode(Encode(int8(-1), uint16(2), float32(0.5), 3))
+	require.NoError(t, err)
+	require.Equal(t, []any{int64(-1), uint64(2), float64(0.5), int64(3)}, elems)
+	nan, err := Decode(Encode(math.NaN()))
+	require.NoError(t, err)
+	require.True(t, math.IsNaN(nan[0].(float64)))
+	// the NaNs with the sign bit set sort after +Inf too
+	negNaN := math.Float64frombits(0xfff8000000000001)
+	require.True(t, math.IsNaN(negNaN))
+	require.Equal(t, Encode(math.NaN()), Encode(negNaN))
+	require.Equal(t, Encode(math.NaN()), Encode(float32(negNaN)))
+	require.Positive(t, bytes.Compare(Encode(negNaN), Encode(math.Inf(1))))
+	require.Panics(t, func() { Encode(true) })
+
+	// the typed reads
+	d := NewDecoder(Encode(int64(-5), "key", []byte{0, 1}, uint64(7), 2.5))
+	require.Equal(t, int64(-5), d.ReadInt64())
+	require.Equal(t, "key", d.ReadString())
+	require.Equal(t, []byte{0, 1}, d.ReadBytes())
+	rest := d.Rest()
+	require.Equal(t, uint64(7), d.ReadUint64())
+	require.Equal(t, 2.5, d.ReadFloat64())
+	require.False(t, d.More())
+	require.NoError(t, d.Err())
+	require.Equal(t, Encode(uint64(7), 2.5), rest)
+
+	t.Run("malformed", func(t *testing.T) {
+		d := NewDecoder(Encode("key"))
+		require.Zero(t, d.ReadInt64(), "wrong type")
+		require.ErrorIs(t, d.Err(), ErrMalformed)
+		require.False(t, d.More())
+		for _, data := range [][]byte{
+			{0x7f},                    // unknown tag
+			{TagInt64, 1, 2, 3},       // truncated
+			{TagString, 'a', 'b'},     // unterminated
+			{TagBytes, 0x01, 0x03, 0}, // bad escape
+			{TagBytes, 0x01},          // truncated escape
+		} {
+			_, err := Decode(data)
+			require.ErrorIs(t, err, ErrMalformed, "%q", data)
+		}
+	})
+}
+
+// scan calls fn on the sorted keys with start <= key < end, like btree.BTree.Scan
+func scan(keys [][]byte, start []byte, end []byte, fn func(key []byte)) {
+	for _, key := range keys {
+		if bytes.Compare(key, start) >= 0 && (end == nil || bytes.Compare(key, end) < 0) {
+			fn(key)
+		}
+	}
+}
+
+func TestPrefixRange(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var tuples [][]any
+	var keys [][]byte
+	for i := 0; i < 2000; i++ {
+		// (user, timestamp, event)
+		tuple := []any{strs[rng.Intn(len(strs))], ints[rng.Intn(len(ints))], uint64(rng.Intn(100))}
+		tuples = append(tuples, tuple)
+		keys = append(keys, Encode(tuple...))
+	}
+	slices.SortFunc(tuples, compareTuples)
+	tuples = slices.CompactFunc(tuples, func(a, b []any) bool { return compareTuples(a, b) == 0 })
+	slices.SortFunc(keys, bytes.Compare)
+	keys = slices.CompactFunc(keys, bytes.Equal)
+
+	for _, prefix := range [][]any{{}, {"a"}, {"a", int64(-1)}, {"\x00"}, {"\xff", int64(math.MaxInt64)}, {"none"}} {
+		var want [][]any
+		for _, tuple := range tuples {
+			if compareTuples(tuple[:len(prefix)], prefix) == 0 {
+				want = append(want, tuple)
+			}
+		}
+		var got [][]any
+		start, end := PrefixRange(prefix...)
+		scan(keys, start, end, func(key []byte) {
+			tuple, err := Decode(key)
+			require.NoError(t, err)
+			got = append(got, tuple)
+		})
+		require.Equal(t, want, got, "%q", prefix)
+	}
+
+	// a range of timestamps of a user
+	var got []int64
+	scan(keys, Encode("a", int64(-256)), Encode("a", int64(256)), func(key []byte) {
+		d := NewDecoder(key)
+		d.ReadString()
+		got = append(got, d.ReadInt64())
+	})
+	require.NotEmpty(t, got)
+	require.True(t, slices.IsSorted(got))
+	require.GreaterOrEqual(t, got[0], int64(-256))
+	require.Less(t, got[len(got)-1], int64(256))
+}
+
+func TestPrefixEnd(t *testing.T) {
+	require.Equal(t, []byte("ab"), PrefixEnd([]byte("aa")))
+	require.Equal(t, []byte("b"), PrefixEnd([]byte("a\xff\xff")))
+	require.Nil(t, PrefixEnd([]byte("\xff\xff")))
+	require.Nil(t, PrefixEnd(nil))
+}
@@ -0,0 +1,89 @@
+package comparator
+
+import "bytes"
+
+// MAX_NAME_SIZE is the max length of a comparator name, as recorded in the kvstore meta page
+const MAX_NAME_SIZE = 32
+
+// Comparator defines the order of the keys of a tree.
+// The empty key is reserved for the dummy key of the leftmost nodes,
+// so it must sort before every other key.
+type Comparator struct {
+	// Name identifies the order. It is recorded in database files, so that opening
+	// a file with a different comparator fails instead of corrupting the tree.
+	Name string
+	// Compare returns an integer comparing a and b, like bytes.Compare.
+	Compare func(a []byte, b []byte) int
+	// PrefixContiguous is set when the keys starting with a given prefix are contiguous in the order,
+	// ie. every key between 2 keys shares their common prefix.
+	// It is required by the prefix compression layout, which only looks at the first and last keys of a node.
+	PrefixContiguous bool
+}
+
+// Bytewise orders the keys as raw bytes, it's the default order.
+var Bytewise = &Comparator{
+	Name:             "bytewise",
+	Compare:          bytes.Compare,
+	PrefixContiguous: true,
+}
+
+// Reverse orders the keys as raw bytes, in decreasing order (except for the empty key).
+var Reverse = &Comparator{
+	Name: "reverse",
+	Compare: func(a []byte, b []byte) int {
+		if len(a) == 0 || len(b) == 0 {
+			return bytes.Compare(a, b) // the empty key stays first
+		}
+		return bytes.Compare(b, a)
+	},
+	PrefixContiguous: true,
+}
+
+// CaseInsensitive orders the keys as raw bytes, ignoring the case of ASCII letters.
+// keys differing only by their case are the same key.
+var CaseInsensitive = &Comparator{
+	Name: "case-insensitive",
+	Compare: func(a []byte, b []byte) int {
+		n := min(len(a), len(b))
+		for i := 0; i < n; i++ {
+			ca, cb := toLower(a[i]), toLower(b[i])
+			if ca != cb {
+				if ca < cb {
+					return -1
+				}
+				return 1
+			}
+		}
+		switch {
+		case len(a) < len(b):
+			return -1
+		case len(a) > len(b):
+			return 1
+		}
+		return 0
+	},
+	// "aa" < "AB" < "ac": the keys starting with "a" aren't contiguous
+	PrefixContiguous: false,
+}
+
+func toLower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// ByName returns the built-in comparator with the given name, if any
+func ByName(name string) (*Comparator, bool) {
+	for _, cmp := range []*Comparator{Bytewise, Reverse, CaseInsensitive} {
+		if cmp.Name == name {
+			return cmp, true
+		}
+	}
+	return nil, false
+}
+
+// IsBytewise reports whether cmp orders the keys as raw bytes, a nil cmp being the default order.
+func IsBytewise(cmp *Comparator) bool {
+	return cmp == nil || cmp.Name == Bytewise.Name
+}
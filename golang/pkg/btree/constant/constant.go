@@ -8,14 +8,55 @@ import (
 // sizes are all in bytes
 const HEADER_SIZE = 4
 
-const BTREE_PAGE_SIZE = 4096
+// a node entry is a pointer, an offset, and the key and value lengths, followed by the KV itself
+const ENTRY_OVERHEAD = 8 + 4 + 4
+
+// the page size is chosen when a tree is created,
+// it must be a power of 2 between MIN_PAGE_SIZE and MAX_PAGE_SIZE
+const (
+	MIN_PAGE_SIZE     = 4096
+	MAX_PAGE_SIZE     = 65536
+	DEFAULT_PAGE_SIZE = 4096
+)
+
+// PAGE_CHECKSUM_SIZE bytes at the end of every page are reserved for the checksum of the page,
+// which is written and verified by the on-disk store. nodes never use them.
+const PAGE_CHECKSUM_SIZE = 4
+
+// NodeCapacity returns the max size of a node stored in a page of pageSize bytes
+func NodeCapacity(pageSize int) int {
+	return pageSize - PAGE_CHECKSUM_SIZE
+}
+
+// the max key size doesn't depend on the page size,
+// as keys are copied into the internal nodes
 const BTREE_MAX_KEY_SIZE = 1000
-const BTREE_MAX_VAL_SIZE = 3000
+
+// the values that don't fit in a node are stored in overflow pages,
+// their size is bounded anyway, it fits in 4 bytes
+const BTREE_MAX_VAL_SIZE = 1<<32 - 1
+
+// room left in a page holding a single KV of max key and value sizes,
+// for the header and the entry overhead.
+// with the default page size, values are at most 2996 bytes.
+const pageSlack = 96
+
+// ValidPageSize reports whether pageSize can be used for a tree
+func ValidPageSize(pageSize int) bool {
+	return MIN_PAGE_SIZE <= pageSize && pageSize <= MAX_PAGE_SIZE && pageSize&(pageSize-1) == 0
+}
+
+// MaxValSize returns the max size of a value stored in a node of the given page size
+func MaxValSize(pageSize int) int {
+	return NodeCapacity(pageSize) - BTREE_MAX_KEY_SIZE - pageSlack
+}
 
 func init() {
 	// we want to make sure we can fit a node into a page
-	node1max := HEADER_SIZE + 8 + 2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE
-	errors.Assert(node1max <= BTREE_PAGE_SIZE, "node1max <= BTREE_PAGE_SIZE")
+	node1max := HEADER_SIZE + ENTRY_OVERHEAD + BTREE_MAX_KEY_SIZE + MaxValSize(MIN_PAGE_SIZE)
+	errors.Assert(node1max <= NodeCapacity(MIN_PAGE_SIZE), "node1max <= NodeCapacity(MIN_PAGE_SIZE)")
+	// the KV lengths are stored on 2 bytes
+	errors.Assert(MaxValSize(MAX_PAGE_SIZE) <= 0xffff, "MaxValSize(MAX_PAGE_SIZE) <= 0xffff")
 }
 
 const NilPagePtr types.PagePtr = 0
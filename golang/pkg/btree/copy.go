@@ -0,0 +1,79 @@
+package btree
+
+import (
+	"encoding/binary"
+	"trees/pkg/btree/bnode"
+	"trees/pkg/btree/constant"
+	"trees/pkg/btree/pagemanager"
+	"trees/pkg/btree/types"
+)
+
+// CopyTo copies the pages reachable from the root, overflow pages included, into dst,
+// and returns the root of the copy, which can be used with the same options as the tree.
+// the kids of a node are copied in key order and before their parent,
+// so when dst appends the pages, the copy is dense and its leaves are laid out in key order.
+func (tree *BTree) CopyTo(dst pagemanager.PageManager) types.PagePtr {
+	if tree.RootPtr == constant.NilPagePtr {
+		return constant.NilPagePtr
+	}
+	return tree.copyNode(dst, tree.RootPtr)
+}
+
+// CopySize returns the number of pages that CopyTo allocates
+func (tree *BTree) CopySize() int {
+	if tree.RootPtr == constant.NilPagePtr {
+		return 0
+	}
+	return tree.copySize(tree.RootPtr)
+}
+
+func (tree *BTree) copySize(ptr types.PagePtr) int {
+	node := tree.node(ptr)
+	count := 1
+	for i := uint16(0); i < node.NumKeys(); i++ {
+		switch node.Type() {
+		case bnode.BNODE_NODE:
+			count += tree.copySize(node.GetPtr(i))
+		case bnode.BNODE_LEAF:
+			// the chains are split into chunks of the same capacity as encodeVal.
+			// the dummy key has no value
+			if val := node.GetVal(i); len(val) > 0 && valTag(ptr, val) == valOverflow {
+				size, _ := decodeOverflowRef(ptr, val)
+				capacity := uint64(bnode.OverflowCapacity(tree.pageSize))
+				count += int((size + capacity - 1) / capacity)
+			}
+		}
+	}
+	return count
+}
+
+func (tree *BTree) copyNode(dst pagemanager.PageManager, ptr types.PagePtr) types.PagePtr {
+	node := bnode.BNode(append([]byte(nil), tree.node(ptr)...))
+	for i := uint16(0); i < node.NumKeys(); i++ {
+		switch node.Type() {
+		case bnode.BNODE_NODE:
+			node.SetPtr(i, tree.copyNode(dst, node.GetPtr(i)))
+		case bnode.BNODE_LEAF:
+			// the value is a slice of the copied node, its reference can be updated in place
+			if val := node.GetVal(i); len(val) > 0 && valTag(ptr, val) == valOverflow {
+				size, first := decodeOverflowRef(ptr, val)
+				binary.LittleEndian.PutUint64(val[9:], uint64(tree.copyOverflow(dst, size, first)))
+			}
+		}
+	}
+	return dst.New(node)
+}
+
+// copy the overflow chain of a value of size bytes, and return its first page
+func (tree *BTree) copyOverflow(dst pagemanager.PageManager, size uint64, first types.PagePtr) types.PagePtr {
+	var chain []bnode.BNode
+	tree.walkOverflow(size, first, func(_ types.PagePtr, page bnode.BNode) {
+		chain = append(chain, page)
+	})
+	// like encodeVal, copy the chain from its end, so that each page knows its next page
+	next := constant.NilPagePtr
+	for i := len(chain) - 1; i >= 0; i-- {
+		next = dst.New(bnode.NewOverflowPage(tree.pageSize, next, chain[i].OverflowData()))
+	}
+	return next
+}
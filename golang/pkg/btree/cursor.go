@@ -0,0 +1,213 @@
+package btree
+
+import (
+	"bytes"
+	"trees/pkg/btree/bnode"
+	"trees/pkg/btree/codec"
+	"trees/pkg/btree/comparator"
+	"trees/pkg/btree/constant"
+	"trees/pkg/btree/pagemanager"
+	"trees/pkg/btree/types"
+)
+
+// Cursor iterates over the KVs of a tree in key order.
+// It keeps the path from the root to the current leaf, so that moving to
+// a neighbouring leaf only needs to walk up to the first common ancestor.
+// The tree must not be modified while a cursor is in use.
+// A corrupted page met on the way stops the cursor: it becomes invalid for good,
+// and Err returns the error, which matches ErrCorruptPage.
+type Cursor struct {
+	tree  *BTree
+	ptrs  []types.PagePtr // pages from the root to the leaf
+	nodes []bnode.BNode   // the nodes of these pages
+	pos   []uint16        // indexes into the nodes
+	valid bool            // false when the cursor moved past either end of the tree
+	err   error           // the corrupted page that stopped the cursor
+}
+
+// Cursor returns an unpositioned cursor over the tree.
+// One of the Seek functions must be called before using it.
+func (tree *BTree) Cursor() *Cursor {
+	return &Cursor{tree: tree}
+}
+
+func (c *Cursor) reset() {
+	c.ptrs, c.nodes, c.pos = c.ptrs[:0], c.nodes[:0], c.pos[:0]
+	c.valid = false
+}
+
+// Err returns the error that stopped the cursor, if any.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// descend from the root, choosing a kid with pick at each level
+func (c *Cursor) descend(pick func(node bnode.BNode) uint16) {
+	defer pagemanager.RecoverCorruption(&c.err)
+	c.reset()
+	if c.err != nil {
+		return
+	}
+	for ptr := c.tree.RootPtr; ptr != constant.NilPagePtr; {
+		node := c.tree.node(ptr)
+		idx := pick(node)
+		c.ptrs = append(c.ptrs, ptr)
+		c.nodes = append(c.nodes, node)
+		c.pos = append(c.pos, idx)
+		if node.Type() == bnode.BNODE_LEAF {
+			c.valid = true
+			return
+		}
+		ptr = node.GetPtr(idx)
+	}
+}
+
+// SeekLE positions the cursor at the largest key less than or equal to key.
+func (c *Cursor) SeekLE(key []byte) {
+	c.descend(func(node bnode.BNode) uint16 { return node.LookupLE(key, c.tree.cmp) })
+}
+
+// Seek positions the cursor at the smallest key greater than or equal to key.
+func (c *Cursor) Seek(key []byte) {
+	c.SeekLE(key)
+	// the dummy key is skipped, even when seeking the empty key
+	if c.err == nil && c.valid && (len(c.currentKey()) == 0 || c.tree.Comparator().Compare(c.currentKey(), key) < 0) {
+		c.Next()
+	}
+}
+
+// First positions the cursor at the smallest key of the tree.
+func (c *Cursor) First() {
+	c.Seek(nil)
+}
+
+// Last positions the cursor at the largest key of the tree.
+func (c *Cursor) Last() {
+	c.descend(func(node bnode.BNode) uint16 { return node.NumKeys() - 1 })
+}
+
+// Valid reports whether the cursor points at a KV.
+func (c *Cursor) Valid() bool {
+	// the dummy key is the only empty key of the tree
+	return c.err == nil && c.valid && len(c.currentKey()) > 0
+}
+
+func (c *Cursor) currentKey() []byte {
+	leaf := len(c.nodes) - 1
+	return c.nodes[leaf].GetKey(c.pos[leaf])
+}
+
+// Key returns the key at the cursor position. The cursor must be valid.
+// The returned slice is only valid until the tree is modified.
+func (c *Cursor) Key() []byte {
+	if !c.Valid() {
+		panic("invalid cursor")
+	}
+	return c.currentKey()
+}
+
+// Value returns the value at the cursor position. The cursor must be valid.
+// The returned slice is only valid until the tree is modified.
+// It returns nil and stops the cursor when an overflow page of the value is corrupted.
+func (c *Cursor) Value() []byte {
+	if !c.Valid() {
+		panic("invalid cursor")
+	}
+	defer pagemanager.RecoverCorruption(&c.err)
+	leaf := len(c.nodes) - 1
+	return c.tree.decodeVal(c.ptrs[leaf], c.nodes[leaf].GetVal(c.pos[leaf]))
+}
+
+// Next moves the cursor to the next key.
+// The cursor becomes invalid when moving past the last key.
+func (c *Cursor) Next() {
+	defer pagemanager.RecoverCorruption(&c.err)
+	if c.err == nil && c.valid && !c.move(len(c.nodes)-1, true) {
+		c.valid = false
+	}
+}
+
+// Prev moves the cursor to the previous key.
+// The cursor becomes invalid when moving past the first key.
+func (c *Cursor) Prev() {
+	defer pagemanager.RecoverCorruption(&c.err)
+	if c.err == nil && c.valid && !c.move(len(c.nodes)-1, false) {
+		c.valid = false
+	}
+	if c.err == nil && c.valid && len(c.currentKey()) == 0 {
+		c.valid = false // moved onto the dummy key
+	}
+}
+
+// move the position at the given level by one, possibly moving the parents too.
+// returns false if there is no neighbouring key in that direction.
+func (c *Cursor) move(level int, forward bool) bool {
+	node := c.nodes[level]
+	switch {
+	case forward && c.pos[level]+1 < node.NumKeys():
+		c.pos[level]++
+	case !forward && c.pos[level] > 0:
+		c.pos[level]--
+	case level > 0 && c.move(level-1, forward):
+		// the parent moved, so this level now holds a new node
+	default:
+		return false // past the first or last key
+	}
+	if level+1 < len(c.nodes) {
+		// load the kid node at the new position
+		kptr := c.nodes[level].GetPtr(c.pos[level])
+		kid := c.tree.node(kptr)
+		c.ptrs[level+1] = kptr
+		c.nodes[level+1] = kid
+		if forward {
+			c.pos[level+1] = 0
+		} else {
+			c.pos[level+1] = kid.NumKeys() - 1
+		}
+	}
+	return true
+}
+
+// Scan calls fn on every KV with start <= key < end, in key order, until fn returns false.
+// A nil end means that there is no upper bound.
+// A corrupted page stops the scan with an error matching ErrCorruptPage.
+func (tree *BTree) Scan(start []byte, end []byte, fn func(key []byte, val []byte) bool) error {
+	cmp := tree.Comparator()
+	c := tree.Cursor()
+	for c.Seek(start); c.Valid(); c.Next() {
+		if end != nil && cmp.Compare(c.Key(), end) >= 0 {
+			return nil
+		}
+		val := c.Value()
+		if c.Err() != nil || !fn(c.Key(), val) {
+			break
+		}
+	}
+	return c.Err()
+}
+
+// ScanPrefix calls fn on every KV whose key starts with prefix, in key order, until fn returns false.
+// A corrupted page stops the scan with an error, like Scan.
+func (tree *BTree) ScanPrefix(prefix []byte, fn func(key []byte, val []byte) bool) error {
+	cmp := tree.Comparator()
+	if comparator.IsBytewise(cmp) {
+		return tree.Scan(prefix, codec.PrefixEnd(prefix), fn)
+	}
+	// in other orders, the keys starting with prefix don't start at prefix: look at all the keys
+	found := false
+	c := tree.Cursor()
+	for c.First(); c.Valid(); c.Next() {
+		if !bytes.HasPrefix(c.Key(), prefix) {
+			if found && cmp.PrefixContiguous {
+				return nil // past the keys starting with prefix
+			}
+			continue
+		}
+		found = true
+		val := c.Value()
+		if c.Err() != nil || !fn(c.Key(), val) {
+			break
+		}
+	}
+	return c.Err()
+}
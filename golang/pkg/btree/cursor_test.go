@@ -0,0 +1,178 @@
+package btree
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"trees/pkg/btree/bnode"
+	"trees/pkg/btree/pagemanager"
+	"trees/pkg/btree/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (c *C) sortedKeys() []string {
+	keys := make([]string, 0, len(c.ref))
+	for key := range c.ref {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return c.tree.Comparator().Compare([]byte(keys[i]), []byte(keys[j])) < 0
+	})
+	return keys
+}
+
+func TestCursor(t *testing.T) {
+	t.Run("empty tree", func(t *testing.T) {
+		c := newC()
+		cur := c.tree.Cursor()
+		cur.First()
+		require.False(t, cur.Valid())
+		cur.Last()
+		require.False(t, cur.Valid())
+		cur.Seek([]byte("a"))
+		require.False(t, cur.Valid())
+	})
+
+	c := newC()
+	for i := 0; i < 3000; i += 2 {
+		c.add(fmt.Sprintf("key-%05d", i), fmt.Sprintf("val-%d", i))
+	}
+	keys := c.sortedKeys()
+
+	t.Run("forward", func(t *testing.T) {
+		var got []string
+		cur := c.tree.Cursor()
+		for cur.First(); cur.Valid(); cur.Next() {
+			require.Equal(t, c.ref[string(cur.Key())], string(cur.Value()))
+			got = append(got, string(cur.Key()))
+		}
+		require.Equal(t, keys, got)
+	})
+
+	t.Run("backward", func(t *testing.T) {
+		var got []string
+		cur := c.tree.Cursor()
+		for cur.Last(); cur.Valid(); cur.Prev() {
+			got = append(got, string(cur.Key()))
+		}
+		require.Len(t, got, len(keys))
+		for i := range got {
+			require.Equal(t, keys[len(keys)-1-i], got[i])
+		}
+	})
+
+	t.Run("seek", func(t *testing.T) {
+		cur := c.tree.Cursor()
+		cur.Seek([]byte("key-00100"))
+		require.Equal(t, "key-00100", string(cur.Key()))
+		cur.Seek([]byte("key-00101"))
+		require.Equal(t, "key-00102", string(cur.Key()))
+		cur.Seek([]byte("a"))
+		require.Equal(t, "key-00000", string(cur.Key()))
+		cur.Seek([]byte("z"))
+		require.False(t, cur.Valid())
+
+		cur.SeekLE([]byte("key-00101"))
+		require.Equal(t, "key-00100", string(cur.Key()))
+		cur.SeekLE([]byte("a"))
+		require.False(t, cur.Valid())
+		cur.SeekLE([]byte("z"))
+		require.Equal(t, "key-02998", string(cur.Key()))
+	})
+
+	t.Run("moving past the ends", func(t *testing.T) {
+		cur := c.tree.Cursor()
+		cur.First()
+		cur.Prev()
+		require.False(t, cur.Valid())
+		cur.Last()
+		cur.Next()
+		require.False(t, cur.Valid())
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		var got []string
+		require.NoError(t, c.tree.Scan([]byte("key-00100"), []byte("key-00110"), func(key, val []byte) bool {
+			got = append(got, string(key))
+			return true
+		}))
+		require.Equal(t, []string{"key-00100", "key-00102", "key-00104", "key-00106", "key-00108"}, got)
+
+		got = nil
+		require.NoError(t, c.tree.ScanPrefix([]byte("key-0200"), func(key, val []byte) bool {
+			got = append(got, string(key))
+			return len(got) < 3
+		}))
+		require.Equal(t, []string{"key-02000", "key-02002", "key-02004"}, got)
+	})
+}
+
+// TestCursorCorrupted checks that a corrupted page stops a cursor with an error
+func TestCursorCorrupted(t *testing.T) {
+	c := newC()
+	for i := 0; i < 3000; i++ {
+		c.add(fmt.Sprintf("key-%05d", i), fmt.Sprintf("val-%d", i))
+	}
+	c.add("key-00000-big", strings.Repeat("big", 3000))
+	pages := c.tree.pageManager.(*pagemanager.InMemory)
+
+	// drop the 2nd leaf from the page manager, reading it fails
+	cur := c.tree.Cursor()
+	cur.First()
+	first := cur.ptrs[len(cur.ptrs)-1]
+	for cur.ptrs[len(cur.ptrs)-1] == first {
+		cur.Next()
+	}
+	leaf := cur.ptrs[len(cur.ptrs)-1]
+	node := bnode.BNode(pages.Get(leaf))
+	pages.Del(leaf)
+	requireCorrupted := func(err error, ptr types.PagePtr) {
+		t.Helper()
+		var cerr *pagemanager.CorruptionError
+		require.ErrorAs(t, err, &cerr)
+		require.ErrorIs(t, err, ErrCorruptPage)
+		require.Equal(t, uint64(ptr), cerr.Page)
+	}
+
+	t.Run("scan", func(t *testing.T) {
+		n := 0
+		err := c.tree.Scan(nil, nil, func(key, val []byte) bool {
+			n++
+			return true
+		})
+		requireCorrupted(err, leaf)
+		require.Positive(t, n, "the KVs of the 1st leaf")
+		require.Less(t, n, len(c.ref))
+		requireCorrupted(c.tree.ScanPrefix([]byte("key-"), func(key, val []byte) bool { return true }), leaf)
+	})
+
+	t.Run("cursor", func(t *testing.T) {
+		cur := c.tree.Cursor()
+		for cur.First(); cur.Valid(); cur.Next() {
+		}
+		requireCorrupted(cur.Err(), leaf)
+		// the cursor is stopped for good
+		cur.First()
+		require.False(t, cur.Valid())
+		cur.Last()
+		require.False(t, cur.Valid())
+
+		cur = c.tree.Cursor()
+		cur.Seek(node.GetKey(1))
+		require.False(t, cur.Valid())
+		requireCorrupted(cur.Err(), leaf)
+	})
+
+	t.Run("overflow value", func(t *testing.T) {
+		cur := c.tree.Cursor()
+		cur.Seek([]byte("key-00000-big"))
+		require.True(t, cur.Valid())
+		_, overflow := decodeOverflowRef(cur.ptrs[len(cur.ptrs)-1], cur.nodes[len(cur.nodes)-1].GetVal(cur.pos[len(cur.pos)-1]))
+		pages.Del(overflow)
+		require.Nil(t, cur.Value())
+		require.False(t, cur.Valid())
+		requireCorrupted(cur.Err(), overflow)
+	})
+}
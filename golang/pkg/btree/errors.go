@@ -0,0 +1,38 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"trees/pkg/btree/constant"
+	"trees/pkg/btree/pagemanager"
+	"trees/pkg/btree/types"
+)
+
+// the errors of Insert, Get and Delete, to be tested with errors.Is
+var (
+	ErrEmptyKey = errors.New("empty key")
+	// ErrKeyTooLarge is returned for the keys of constant.BTREE_MAX_KEY_SIZE bytes or more
+	ErrKeyTooLarge = errors.New("key too large")
+	// ErrValueTooLarge is returned for the values of more than constant.BTREE_MAX_VAL_SIZE bytes
+	ErrValueTooLarge = errors.New("value too large")
+	// ErrCorruptPage is matched by the *pagemanager.CorruptionError of a page that can't be trusted
+	ErrCorruptPage = pagemanager.ErrCorruptPage
+)
+
+// checkKV returns the error of a KV that can't be inserted
+func checkKV(key []byte, val []byte) error {
+	switch {
+	case len(key) == 0:
+		return ErrEmptyKey
+	case len(key) >= constant.BTREE_MAX_KEY_SIZE:
+		return fmt.Errorf("%w: %d bytes, the max is %d", ErrKeyTooLarge, len(key), constant.BTREE_MAX_KEY_SIZE-1)
+	case uint64(len(val)) > constant.BTREE_MAX_VAL_SIZE:
+		return fmt.Errorf("%w: %d bytes, the max is %d", ErrValueTooLarge, len(val), uint64(constant.BTREE_MAX_VAL_SIZE))
+	}
+	return nil
+}
+
+// corrupted panics with the *pagemanager.CorruptionError of a page
+func corrupted(ptr types.PagePtr, format string, args ...any) {
+	panic(&pagemanager.CorruptionError{Page: uint64(ptr), Reason: fmt.Sprintf(format, args...)})
+}
@@ -0,0 +1,81 @@
+package kvstore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"trees/pkg/btree/constant"
+	"trees/pkg/btree/pagemanager"
+	"trees/pkg/btree/types"
+)
+
+// Backup writes a copy of the last committed version to w, which can be opened as a database file.
+// only the pages reachable from the root are written, densely like a compacted file.
+// the copy is read from a snapshot, so the writers are not blocked.
+func (db *KV) Backup(w io.Writer) (err error) {
+	snap := db.Snapshot()
+	defer snap.Release()
+	defer pagemanager.RecoverCorruption(&err)
+	// the pages of the copy are numbered from 1, and the root is copied after its kids:
+	// the meta page, which comes first, can be written once the pages are counted.
+	count := snap.tree.CopySize()
+	root := constant.NilPagePtr
+	if count > 0 {
+		root = types.PagePtr(count)
+	}
+	meta := metaPage{
+		root:       root,
+		flushed:    uint64(count) + 1,
+		pageSize:   db.pageSize,
+		comparator: db.cmp.Name,
+		flags:      db.flags &^ META_FLAG_WAL,
+		version:    1,
+		freeHead:   uint64(constant.NilPagePtr),
+	}
+	// like the 1st update of a new file, which starts with an empty tree, see initMeta
+	empty := meta
+	empty.root, empty.flushed, empty.version = constant.NilPagePtr, 1, 0
+	page := make([]byte, db.pageSize)
+	copy(page[metaSlotOffset(0):], serializeMeta(empty))
+	copy(page[metaSlotOffset(1):], serializeMeta(meta))
+	if _, err := w.Write(page); err != nil {
+		return err
+	}
+	stream := pagemanager.NewStream(w, db.pageSize, 1)
+	copied := snap.tree.CopyTo(stream)
+	if err := stream.Err(); err != nil {
+		return err
+	}
+	if copied != root {
+		return fmt.Errorf("the copy root is page %d, not %d", copied, root)
+	}
+	return nil
+}
+
+// BackupFile writes a backup of the last committed version into the file at path, see Backup.
+// the file is replaced once the backup is complete and durable, it can't be the database file or its log.
+func (db *KV) BackupFile(path string) error {
+	if db.Path != "" && (isSameFile(path, db.Path) || isSameFile(path, db.Path+".wal")) {
+		return fmt.Errorf("backup %s: the backup would replace the database", path)
+	}
+	snap := db.Snapshot()
+	defer snap.Release()
+	return replaceWithCopy(path, snap.tree, db.cmp, db.flags)
+}
+
+// isSameFile reports whether the paths a and b name the same file, through links for instance
+func isSameFile(a string, b string) bool {
+	if filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(infoA, infoB)
+}
@@ -0,0 +1,134 @@
+package kvstore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"trees/pkg/btree/storage"
+
+	"github.com/stretchr/testify/require"
+)
+
+// openBytes opens a database file held in memory
+func openBytes(t *testing.T, data []byte, opts Options) *KV {
+	t.Helper()
+	file := storage.NewMemFile()
+	_, err := file.WriteAt(data, 0)
+	require.NoError(t, err)
+	db, err := OpenFile(file, opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// blockingWriter blocks the first write until unblock is closed
+type blockingWriter struct {
+	bytes.Buffer
+	started chan struct{}
+	unblock chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	if w.Len() == 0 {
+		close(w.started)
+		<-w.unblock
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestBackup(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(filepath.Join(dir, "test.db"), Options{PrefixCompression: true})
+	require.NoError(t, err)
+	defer db.Close()
+	for i := 0; i < 2000; i++ {
+		val := fmt.Sprintf("val-%d", i)
+		if i%200 == 0 {
+			val = strings.Repeat("big", 5000) // overflow pages
+		}
+		require.NoError(t, db.Set([]byte(fmt.Sprintf("key-%05d", i)), []byte(val)))
+	}
+	for i := 0; i < 2000; i += 2 {
+		_, err := db.Del([]byte(fmt.Sprintf("key-%05d", i)))
+		require.NoError(t, err)
+	}
+	want := contents(t, db)
+
+	// the writers keep going during the backup, which copies the version it started with
+	w := &blockingWriter{started: make(chan struct{}), unblock: make(chan struct{})}
+	done := make(chan error)
+	go func() { done <- db.Backup(w) }()
+	<-w.started
+	for i := 0; i < 2000; i += 40 {
+		require.NoError(t, db.Set([]byte(fmt.Sprintf("key-%05d", i)), []byte("new")))
+	}
+	close(w.unblock)
+	require.NoError(t, <-done)
+
+	backup := openBytes(t, w.Bytes(), Options{})
+	require.Equal(t, want, contents(t, backup))
+	require.Equal(t, uint64(1), backup.version)
+	require.NotZero(t, backup.flags&META_FLAG_PREFIX_COMPRESSION)
+	require.Equal(t, uint64(len(reachablePages(backup))+1), backup.pages.Flushed(), "only the reachable pages")
+	require.Equal(t, int64(w.Len()), int64(backup.pages.Flushed())*int64(backup.pageSize))
+	// the backup is a regular database file
+	require.NoError(t, backup.Set([]byte("key-00000"), []byte("after")))
+	val, ok := mustGet(t, backup, "key-00000")
+	require.True(t, ok)
+	require.Equal(t, "after", string(val))
+
+	t.Run("file", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, db.Backup(&buf))
+		path := filepath.Join(dir, "backup.db")
+		require.NoError(t, os.WriteFile(path, []byte("an older backup"), 0o644))
+		require.NoError(t, db.BackupFile(path))
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, buf.Bytes(), data, "the same copy")
+		backup, err := Open(path, Options{})
+		require.NoError(t, err)
+		defer backup.Close()
+		require.Equal(t, contents(t, db), contents(t, backup))
+	})
+
+	t.Run("database file", func(t *testing.T) {
+		before, err := os.ReadFile(db.Path)
+		require.NoError(t, err)
+		link := filepath.Join(dir, "link.db")
+		require.NoError(t, os.Symlink(db.Path, link))
+		hardLink := filepath.Join(dir, "hardlink.db")
+		require.NoError(t, os.Link(db.Path, hardLink))
+		for _, path := range []string{db.Path, filepath.Join(dir, ".", "test.db"), link, hardLink} {
+			require.ErrorContains(t, db.BackupFile(path), "would replace the database")
+		}
+		after, err := os.ReadFile(db.Path)
+		require.NoError(t, err)
+		require.Equal(t, before, after)
+	})
+
+	t.Run("write error", func(t *testing.T) {
+		require.ErrorIs(t, db.Backup(failingWriter{}), io.ErrShortWrite)
+	})
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, io.ErrShortWrite
+}
+
+func TestBackupEmpty(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), Options{})
+	require.NoError(t, err)
+	defer db.Close()
+	var buf bytes.Buffer
+	require.NoError(t, db.Backup(&buf))
+	backup := openBytes(t, buf.Bytes(), Options{})
+	require.Empty(t, contents(t, backup))
+	require.NoError(t, backup.Set([]byte("a"), []byte("1")))
+}
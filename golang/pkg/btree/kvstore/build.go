@@ -0,0 +1,130 @@
+package kvstore
+
+import (
+	"fmt"
+	"os"
+	"trees/pkg/btree"
+	"trees/pkg/btree/comparator"
+	"trees/pkg/btree/constant"
+	"trees/pkg/btree/pagemanager"
+	"trees/pkg/btree/storage"
+)
+
+// BuildOptions are the settings of a database file created from sorted KVs
+type BuildOptions struct {
+	// PageSize defaults to constant.DEFAULT_PAGE_SIZE
+	PageSize int
+	// FillFactor is the fraction of each page filled by the built nodes, defaults to 1
+	FillFactor float64
+	// PrefixCompression turns on the prefix compression layout, see Options
+	PrefixCompression bool
+	// Comparator is the order of the keys, defaults to comparator.Bytewise
+	Comparator *comparator.Comparator
+}
+
+// number of pages buffered in memory before being written to the file while bulk loading
+const buildFlushPages = 1024
+
+// Build creates a new database file from KVs in strictly increasing key order, in a single pass.
+// next returns the KVs one by one, and false once there are no more.
+// the file must not exist or be empty. it's built into a temporary file, which replaces it once
+// complete and durable: a failed build leaves it untouched.
+func Build(path string, opts BuildOptions, next func() (key []byte, val []byte, ok bool)) error {
+	if opts.PageSize == 0 {
+		opts.PageSize = constant.DEFAULT_PAGE_SIZE
+	}
+	if !constant.ValidPageSize(opts.PageSize) {
+		return fmt.Errorf("invalid page size %d", opts.PageSize)
+	}
+	if opts.Comparator == nil {
+		opts.Comparator = comparator.Bytewise
+	}
+	if len(opts.Comparator.Name) > comparator.MAX_NAME_SIZE {
+		return fmt.Errorf("comparator name %q is too long", opts.Comparator.Name)
+	}
+	if opts.PrefixCompression && !opts.Comparator.PrefixContiguous {
+		return fmt.Errorf("prefix compression requires a prefix contiguous comparator")
+	}
+	if opts.FillFactor == 0 {
+		opts.FillFactor = 1
+	}
+
+	size, err := osFileSize(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if size != 0 {
+		return fmt.Errorf("%s is not empty", path)
+	}
+	return replaceFile(path, func(tmp string) error {
+		return build(tmp, opts, next)
+	})
+}
+
+// build creates the database file of Build at path
+func build(path string, opts BuildOptions, next func() (key []byte, val []byte, ok bool)) error {
+	var flags uint32
+	if opts.PrefixCompression {
+		flags |= META_FLAG_PREFIX_COMPRESSION
+	}
+	db, err := createFile(path, opts.PageSize, opts.Comparator, flags)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	builder, err := btree.NewBuilder(db.tree, opts.FillFactor)
+	if err != nil {
+		return err
+	}
+	for {
+		key, val, ok := next()
+		if !ok {
+			break
+		}
+		if err := builder.Add(key, val); err != nil {
+			return err
+		}
+		// the pages are final, write them as we go
+		if db.pages.Pending() >= buildFlushPages {
+			if err := db.pages.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	builder.Finish()
+	return updateFile(db, db.tree.RootPtr)
+}
+
+// createFile creates a new database file at path, which must not exist or be empty,
+// and returns the KV to write its pages. the file starts with the meta page of an empty tree.
+// without free page hooks, the page manager of the KV only appends pages.
+func createFile(path string, pageSize int, cmp *comparator.Comparator, flags uint32) (*KV, error) {
+	file, err := storage.OpenOSFile(path)
+	if err != nil {
+		return nil, err
+	}
+	size, err := file.Size()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if size != 0 {
+		_ = file.Close()
+		return nil, fmt.Errorf("%s is not empty", path)
+	}
+	db := &KV{Path: path, pageSize: pageSize, cmp: cmp, flags: flags}
+	if db.pages, err = pagemanager.NewOnDisk(file, pageSize, 1); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	db.tree = btree.New(db.pages, btree.Options{
+		PageSize:          pageSize,
+		PrefixCompression: flags&META_FLAG_PREFIX_COMPRESSION != 0,
+		Comparator:        cmp,
+	})
+	if err := initMeta(db); err != nil {
+		_ = db.pages.Close()
+		return nil, err
+	}
+	return db, nil
+}
@@ -0,0 +1,119 @@
+package kvstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"trees/pkg/btree"
+	"trees/pkg/btree/comparator"
+	"trees/pkg/btree/pagemanager"
+	"trees/pkg/btree/storage"
+	"trees/pkg/btree/types"
+)
+
+// CompactStats reports the size of a database file before and after its compaction, in bytes
+type CompactStats struct {
+	SizeBefore int64
+	SizeAfter  int64
+}
+
+// Compact rewrites the database file at path into a minimal file: the pages reachable from the root
+// are copied densely into a new file, with a fresh meta page, which then replaces the original file.
+// the file must not be open. opts are the options to open it, see Open.
+func Compact(path string, opts Options) (stats CompactStats, err error) {
+	if stats.SizeBefore, err = osFileSize(path); err != nil {
+		return stats, err
+	}
+	db, err := Open(path, opts)
+	if err != nil {
+		return stats, err
+	}
+	closed := false
+	defer func() {
+		if !closed {
+			_ = db.Close()
+		}
+	}()
+
+	err = replaceFile(path, func(tmp string) error {
+		if err := writeCopy(tmp, db.tree, db.cmp, db.flags); err != nil {
+			return err
+		}
+		// the file is closed before it's replaced: in WAL mode, Close checkpoints the log into it
+		closed = true
+		return db.Close()
+	})
+	if err != nil {
+		return stats, fmt.Errorf("compact %s: %w", path, err)
+	}
+	stats.SizeAfter, err = osFileSize(path)
+	return stats, err
+}
+
+// replaceWithCopy writes a dense copy of tree into a new file, which then replaces the file at path, if any.
+// the copy only replaces the file once it's complete and durable.
+func replaceWithCopy(path string, tree *btree.BTree, cmp *comparator.Comparator, flags uint32) error {
+	return replaceFile(path, func(tmp string) error {
+		return writeCopy(tmp, tree, cmp, flags)
+	})
+}
+
+// replaceFile creates a new file with write, which then replaces the file at path, if any.
+// write creates the file at tmp and makes it durable. the file at path is left untouched
+// if write fails, and the temporary file is removed.
+func replaceFile(path string, write func(tmp string) error) error {
+	tmp := path + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := write(tmp); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return storage.SyncDir(filepath.Dir(path))
+}
+
+func osFileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// appendPages appends the pages to the file, and writes them as they come
+type appendPages struct {
+	*pagemanager.OnDisk
+	// the first error of a flush
+	err error
+}
+
+func (p *appendPages) New(node []byte) types.PagePtr {
+	ptr := p.OnDisk.Append(node)
+	if p.err == nil && p.Pending() >= buildFlushPages {
+		p.err = p.Flush()
+	}
+	return ptr
+}
+
+// writeCopy creates a new database file at path, holding a dense copy of tree, and makes it durable.
+// the keys of tree are ordered by cmp, and flags are the meta page flags of its file.
+func writeCopy(path string, tree *btree.BTree, cmp *comparator.Comparator, flags uint32) (err error) {
+	defer pagemanager.RecoverCorruption(&err)
+	// the copy has no log to replay
+	db, err := createFile(path, tree.PageSize(), cmp, flags&^META_FLAG_WAL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	pages := &appendPages{OnDisk: db.pages}
+	root := tree.CopyTo(pages)
+	if pages.err != nil {
+		return pages.err
+	}
+	return updateFile(db, root)
+}
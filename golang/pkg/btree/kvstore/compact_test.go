@@ -0,0 +1,162 @@
+package kvstore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"trees/pkg/btree/bnode"
+	"trees/pkg/btree/comparator"
+	"trees/pkg/btree/constant"
+	"trees/pkg/btree/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// reachablePages returns the pages reachable from the root, in the order of a depth first walk
+func reachablePages(db *KV) []types.PagePtr {
+	var ptrs []types.PagePtr
+	var walk func(ptr types.PagePtr)
+	walk = func(ptr types.PagePtr) {
+		ptrs = append(ptrs, ptr)
+		node := bnode.BNode(db.pages.Get(ptr))
+		switch node.Type() {
+		case bnode.BNODE_NODE:
+			for i := uint16(0); i < node.NumKeys(); i++ {
+				walk(node.GetPtr(i))
+			}
+		case bnode.BNODE_OVERFLOW:
+			if next := node.OverflowNext(); next != constant.NilPagePtr {
+				walk(next)
+			}
+		case bnode.BNODE_LEAF:
+			for i := uint16(0); i < node.NumKeys(); i++ {
+				// the overflow reference holds the first page of the chain
+				if val := node.GetVal(i); len(val) > 0 && val[0] == 2 {
+					walk(types.PagePtr(binary.LittleEndian.Uint64(val[9:])))
+				}
+			}
+		}
+	}
+	if db.tree.RootPtr != constant.NilPagePtr {
+		walk(db.tree.RootPtr)
+	}
+	return ptrs
+}
+
+func TestCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{PrefixCompression: true, Comparator: comparator.Reverse})
+	require.NoError(t, err)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 3000; i++ {
+		val := fmt.Sprintf("val-%d", i)
+		if i%100 == 0 {
+			val = strings.Repeat("big", 3000) // overflow pages
+		}
+		require.NoError(t, db.Set([]byte(fmt.Sprintf("key-%05d", rng.Intn(5000))), []byte(val)))
+	}
+	for i := 0; i < 5000; i += 3 {
+		_, err := db.Del([]byte(fmt.Sprintf("key-%05d", i)))
+		require.NoError(t, err)
+	}
+	want := contents(t, db)
+	require.NoError(t, db.Close())
+
+	stats, err := Compact(path, Options{Comparator: comparator.Reverse})
+	require.NoError(t, err)
+	require.Less(t, stats.SizeAfter, stats.SizeBefore)
+	require.Equal(t, stats.SizeAfter, fileSize(t, path))
+	_, err = os.Stat(path + ".tmp")
+	require.True(t, os.IsNotExist(err), "the temporary file is renamed")
+
+	db, err = Open(path, Options{Comparator: comparator.Reverse})
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, want, contents(t, db))
+	require.NotZero(t, db.flags&META_FLAG_PREFIX_COMPRESSION)
+	// the file only holds the meta page and the reachable pages
+	ptrs := reachablePages(db)
+	require.Equal(t, uint64(len(ptrs)+1), db.pages.Flushed())
+	require.Empty(t, db.free.entries)
+	require.Equal(t, int64(len(ptrs)+1)*constant.DEFAULT_PAGE_SIZE, stats.SizeAfter)
+	// the leaves are laid out in key order
+	var leaves []types.PagePtr
+	for _, ptr := range ptrs {
+		if bnode.BNode(db.pages.Get(ptr)).Type() == bnode.BNODE_LEAF {
+			leaves = append(leaves, ptr)
+		}
+	}
+	require.Greater(t, len(leaves), 1)
+	require.True(t, slices.IsSorted(leaves))
+	// the compacted file can be updated
+	require.NoError(t, db.Set([]byte("new"), []byte("val")))
+	val, ok := mustGet(t, db, "new")
+	require.True(t, ok)
+	require.Equal(t, "val", string(val))
+}
+
+func TestCompactEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	require.NoError(t, err)
+	require.NoError(t, db.Set([]byte("a"), []byte("1")))
+	_, err = db.Del([]byte("a"))
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	stats, err := Compact(path, Options{})
+	require.NoError(t, err)
+	require.Less(t, stats.SizeAfter, stats.SizeBefore)
+	db, err = Open(path, Options{})
+	require.NoError(t, err)
+	defer db.Close()
+	require.Empty(t, contents(t, db))
+
+	_, err = Compact(filepath.Join(t.TempDir(), "missing", "test.db"), Options{})
+	require.Error(t, err)
+}
+
+func TestCompactWAL(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	db, err := Open(path, Options{WAL: true})
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, db.Set([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("val-%d", i))))
+	}
+	for i := 0; i < 1000; i += 2 {
+		_, err := db.Del([]byte(fmt.Sprintf("key-%04d", i)))
+		require.NoError(t, err)
+	}
+	want := contents(t, db)
+	// a copy of the files as left by a crash, the last commits are in the log only
+	crashed := filepath.Join(dir, "crashed.db")
+	for _, ext := range []string{"", ".wal"} {
+		data, err := os.ReadFile(path + ext)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(crashed+ext, data, 0o644))
+	}
+	require.NoError(t, db.Close())
+
+	for _, path := range []string{path, crashed} {
+		size := fileSize(t, path)
+		stats, err := Compact(path, Options{WAL: true})
+		require.NoError(t, err)
+		require.Equal(t, size, stats.SizeBefore)
+		require.Less(t, stats.SizeAfter, stats.SizeBefore)
+		require.Equal(t, uint64(1), fileVersion(t, path))
+
+		// the compacted file is not marked, and the log is not replayed into it
+		for _, opts := range []Options{{}, {WAL: true}} {
+			db, err := Open(path, opts)
+			require.NoError(t, err)
+			require.Equal(t, want, contents(t, db))
+			require.NoError(t, db.Close())
+		}
+	}
+}
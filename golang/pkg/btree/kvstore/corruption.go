@@ -0,0 +1,21 @@
+package kvstore
+
+import (
+	"trees/pkg/btree"
+	"trees/pkg/btree/pagemanager"
+)
+
+// the errors of the updates and reads, see btree.BTree.Insert
+var (
+	ErrEmptyKey      = btree.ErrEmptyKey
+	ErrKeyTooLarge   = btree.ErrKeyTooLarge
+	ErrValueTooLarge = btree.ErrValueTooLarge
+	// ErrCorruptPage is matched by every *CorruptionError
+	ErrCorruptPage = btree.ErrCorruptPage
+)
+
+// CorruptionError reports a page of the file that can't be trusted:
+// its content doesn't match its checksum, or it's out of the file.
+// the pages are verified by the page manager as they are read deep inside the tree code,
+// which panics with a *CorruptionError, recovered by the KV methods and the cursors.
+type CorruptionError = pagemanager.CorruptionError
@@ -0,0 +1,98 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"trees/pkg/btree/constant"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPageChecksums(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	db, err := Open(path, Options{})
+	require.NoError(t, err)
+	tx := db.Begin()
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, tx.Set([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("val-%d", i))))
+	}
+	require.NoError(t, tx.Commit())
+	// some free pages, to have a free list page
+	require.NoError(t, db.Set([]byte("key-0000"), []byte("new")))
+	root, flushed, freeHead := uint64(db.tree.RootPtr), db.pages.Flushed(), db.free.head()
+	freePages := slices.Clone(db.free.pages)
+	require.NotZero(t, freeHead)
+	require.NoError(t, db.Close())
+	good, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	// flip a bit of a page
+	corrupt := func(t *testing.T, ptr uint64) *KV {
+		data := append([]byte(nil), good...)
+		data[int(ptr)*constant.DEFAULT_PAGE_SIZE+100] ^= 1
+		path := filepath.Join(dir, fmt.Sprintf("page%d.db", ptr))
+		require.NoError(t, os.WriteFile(path, data, 0o644))
+		db, err := Open(path, Options{})
+		require.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+	requireCorrupted := func(t *testing.T, err error, ptr uint64) {
+		var cerr *CorruptionError
+		require.True(t, errors.As(err, &cerr), "%v is not a corruption error", err)
+		require.ErrorIs(t, err, ErrCorruptPage)
+		require.Equal(t, ptr, cerr.Page)
+		require.ErrorContains(t, err, fmt.Sprintf("page %d", ptr))
+	}
+
+	t.Run("root", func(t *testing.T) {
+		db := corrupt(t, root)
+		_, _, err := db.Get([]byte("key-0001"))
+		requireCorrupted(t, err, root)
+		err = db.Set([]byte("key-0001"), []byte("x"))
+		requireCorrupted(t, err, root)
+		// the failed transaction was aborted
+		require.NoError(t, db.Begin().Commit())
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		// some pages, but the meta and free list pages
+		failed := 0
+		for ptr := uint64(1); ptr < flushed; ptr += 1 + flushed/10 {
+			if slices.Contains(freePages, ptr) {
+				continue
+			}
+			db := corrupt(t, ptr)
+			err := db.Scan(nil, nil, func(key []byte, val []byte) bool { return true })
+			// a cursor stops at the same page
+			snap := db.Snapshot()
+			cur := snap.Cursor()
+			for cur.First(); cur.Valid(); cur.Next() {
+				cur.Value()
+			}
+			snap.Release()
+			if err != nil {
+				requireCorrupted(t, err, ptr)
+				requireCorrupted(t, cur.Err(), ptr)
+				failed++
+			} else {
+				require.NoError(t, cur.Err())
+			}
+		}
+		require.NotZero(t, failed, "the pages reachable from the root are verified")
+	})
+
+	t.Run("free list", func(t *testing.T) {
+		data := append([]byte(nil), good...)
+		data[int(freeHead)*constant.DEFAULT_PAGE_SIZE+20] ^= 1
+		path := filepath.Join(dir, "freelist.db")
+		require.NoError(t, os.WriteFile(path, data, 0o644))
+		_, err := Open(path, Options{})
+		requireCorrupted(t, err, freeHead)
+	})
+}
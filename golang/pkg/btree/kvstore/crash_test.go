@@ -0,0 +1,157 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand"
+	"testing"
+	"trees/pkg/btree/storage"
+
+	"github.com/stretchr/testify/require"
+)
+
+// contents reads all the KVs of db
+func contents(t *testing.T, db *KV) map[string]string {
+	t.Helper()
+	kvs := map[string]string{}
+	require.NoError(t, db.Scan(nil, nil, func(key []byte, val []byte) bool {
+		kvs[string(key)] = string(val)
+		return true
+	}))
+	return kvs
+}
+
+// TestCrashRecovery runs random transactions on a file that crashes at a random point,
+// with some failed fsyncs on the way. the file recovered after the crash, with a random
+// subset of its unsynced writes, must hold one of the versions that may have been committed.
+func TestCrashRecovery(t *testing.T) {
+	testCrashRecovery(t, false)
+}
+
+// TestCrashRecoveryWAL is TestCrashRecovery in WAL mode: the file and its log crash together,
+// and the fsyncs of both can fail. the checkpoints run at random points.
+func TestCrashRecoveryWAL(t *testing.T) {
+	testCrashRecovery(t, true)
+}
+
+// TestCrashFirstUpdate crashes a new file at every point of its 1st update:
+// the recovered file holds an empty database, or the update.
+func TestCrashFirstUpdate(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	for n := 0; ; n++ {
+		file := storage.NewMemFile()
+		db, err := OpenFile(file, Options{})
+		require.NoError(t, err)
+		file.CrashAfter(n)
+		want := map[string]string{}
+		tx := db.Begin()
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("key-%03d", i)
+			want[key] = "val"
+			require.NoError(t, tx.Set([]byte(key), []byte("val")))
+		}
+		err = tx.Commit()
+		crashed := file.Crashed()
+		require.Equal(t, crashed, err != nil)
+		_ = db.Close()
+
+		for i := 0; i < 10; i++ {
+			db, err := OpenFile(file.Recover(rng), Options{})
+			require.NoError(t, err, "crash after %d operations", n)
+			got := contents(t, db)
+			if crashed && len(got) == 0 {
+				require.Equal(t, uint64(0), db.version)
+			} else {
+				require.Equal(t, want, got)
+			}
+			require.NoError(t, db.Close())
+		}
+		if !crashed {
+			return
+		}
+	}
+}
+
+func testCrashRecovery(t *testing.T, wal bool) {
+	open := func(file storage.File, log storage.File) (*KV, error) {
+		if wal {
+			return OpenFileWithLog(file, log, Options{})
+		}
+		return OpenFile(file, Options{})
+	}
+	for seed := int64(0); seed < 100; seed++ {
+		t.Run(fmt.Sprintf("seed %d", seed), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(seed))
+			file := storage.NewMemFile()
+			log := file.Sibling()
+			db, err := open(file, log)
+			require.NoError(t, err)
+			// the crash can happen during the 1st update of the new file
+			state := map[string]string{}
+			// the versions the file may hold after the crash
+			possible := []map[string]string{state}
+
+			crash := rng.Intn(300)
+			if rng.Intn(4) == 0 {
+				// during the 1st commits
+				crash = rng.Intn(20)
+			}
+			file.CrashAfter(crash)
+			for !file.Crashed() {
+				if wal && rng.Intn(5) == 0 {
+					// a checkpoint doesn't change the contents, even when it fails
+					_ = db.Checkpoint()
+				}
+				next := maps.Clone(state)
+				tx := db.Begin()
+				for i := rng.Intn(20); i >= 0; i-- {
+					key := fmt.Sprintf("key-%03d", rng.Intn(200))
+					if rng.Intn(4) == 0 {
+						delete(next, key)
+						_, err := tx.Del([]byte(key))
+						require.NoError(t, err)
+						continue
+					}
+					val := fmt.Sprintf("%s-%d", key, rng.Int())
+					val += string(make([]byte, rng.Intn(500)))
+					next[key] = val
+					require.NoError(t, tx.Set([]byte(key), []byte(val)))
+				}
+				if rng.Intn(5) == 0 {
+					// before or after the meta page write, or the log write of a later commit
+					failing := file
+					if wal && rng.Intn(2) == 0 {
+						failing = log
+					}
+					failing.FailSync(rng.Intn(2), errors.New("injected fsync failure"))
+				}
+				if err := tx.Commit(); err != nil {
+					// the update may or may not have reached the disk
+					possible = append(possible, next)
+					// the KV keeps serving the last committed version
+					require.Equal(t, state, contents(t, db))
+					continue
+				}
+				state = next
+				possible = []map[string]string{state}
+			}
+			if err := db.Close(); wal {
+				// the last checkpoint
+				require.ErrorIs(t, err, storage.ErrCrashed)
+			} else {
+				require.NoError(t, err)
+			}
+
+			db, err = open(file.Recover(rng), log.Recover(rng))
+			require.NoError(t, err)
+			defer db.Close()
+			require.Contains(t, possible, contents(t, db))
+			// the recovered file is usable
+			require.NoError(t, db.Set([]byte("after"), []byte("crash")))
+			val, ok := mustGet(t, db, "after")
+			require.True(t, ok)
+			require.Equal(t, "crash", string(val))
+		})
+	}
+}
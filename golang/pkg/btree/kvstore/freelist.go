@@ -0,0 +1,122 @@
+package kvstore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"trees/pkg/btree/constant"
+	"trees/pkg/btree/types"
+)
+
+// BNODE_FREE_LIST is the type of the pages holding the persisted free list.
+// the free list is a chain of pages, rewritten as a whole on each update:
+// | type | count | next | count * (ptr, version) |
+// |  2B  |   2B  |  8B  |    count * (8B, 8B)    |
+const BNODE_FREE_LIST = 4
+
+const (
+	FREE_LIST_HEADER_SIZE = 12
+	FREE_LIST_ENTRY_SIZE  = 16
+)
+
+// freeList tracks the pages that are no longer used by the tree.
+// a page freed by the update creating version v is still part of version v-1,
+// so it's only reused once no reader can see version v-1 anymore.
+type freeList struct {
+	// the free pages, in the order they were freed, thus in increasing version order
+	entries []freeEntry
+	// the pages holding the persisted list
+	pages []uint64
+}
+
+type freeEntry struct {
+	ptr uint64
+	// the version of the update that freed the page
+	version uint64
+}
+
+// number of entries held by a free list page
+func freeListCapacity(pageSize int) int {
+	return (constant.NodeCapacity(pageSize) - FREE_LIST_HEADER_SIZE) / FREE_LIST_ENTRY_SIZE
+}
+
+// add a page freed by the update creating version
+func (fl *freeList) push(ptr uint64, version uint64) {
+	fl.entries = append(fl.entries, freeEntry{ptr: ptr, version: version})
+}
+
+// pop returns the oldest free page if it was freed at a version <= threshold
+func (fl *freeList) pop(threshold uint64) (uint64, bool) {
+	if len(fl.entries) == 0 || fl.entries[0].version > threshold {
+		return 0, false
+	}
+	ptr := fl.entries[0].ptr
+	fl.entries = fl.entries[1:]
+	return ptr, true
+}
+
+// save writes the free list into new pages allocated by the update creating version,
+// the pages of the previous list are freed.
+func (fl *freeList) save(db *KV, version uint64) {
+	for _, ptr := range fl.pages {
+		fl.push(ptr, version)
+	}
+	fl.pages = fl.pages[:0]
+	// allocating a page may reuse a free page, which shrinks the list
+	capacity := freeListCapacity(db.pageSize)
+	var nodes [][]byte
+	for len(nodes)*capacity < len(fl.entries) {
+		node := make([]byte, db.pageSize)
+		fl.pages = append(fl.pages, uint64(db.pages.New(node)))
+		nodes = append(nodes, node)
+	}
+	entries := fl.entries
+	for i, node := range nodes {
+		count := min(capacity, len(entries))
+		binary.LittleEndian.PutUint16(node[0:], BNODE_FREE_LIST)
+		binary.LittleEndian.PutUint16(node[2:], uint16(count))
+		if i+1 < len(nodes) {
+			binary.LittleEndian.PutUint64(node[4:], fl.pages[i+1])
+		}
+		for j, entry := range entries[:count] {
+			pos := FREE_LIST_HEADER_SIZE + j*FREE_LIST_ENTRY_SIZE
+			binary.LittleEndian.PutUint64(node[pos:], entry.ptr)
+			binary.LittleEndian.PutUint64(node[pos+8:], entry.version)
+		}
+		entries = entries[count:]
+	}
+}
+
+// the first page of the persisted list
+func (fl *freeList) head() uint64 {
+	if len(fl.pages) == 0 {
+		return uint64(constant.NilPagePtr)
+	}
+	return fl.pages[0]
+}
+
+// load reads the free list persisted from the page head
+func (fl *freeList) load(db *KV, head uint64) error {
+	fl.entries, fl.pages = nil, nil
+	flushed := db.pages.Flushed()
+	for ptr := head; ptr != uint64(constant.NilPagePtr); {
+		if ptr >= flushed || len(fl.pages) >= int(flushed) {
+			return fmt.Errorf("bad free list page %d", ptr)
+		}
+		node := db.pages.Get(types.PagePtr(ptr))
+		count := int(binary.LittleEndian.Uint16(node[2:]))
+		if binary.LittleEndian.Uint16(node[0:]) != BNODE_FREE_LIST || count > freeListCapacity(db.pageSize) {
+			return fmt.Errorf("bad free list page %d", ptr)
+		}
+		fl.pages = append(fl.pages, ptr)
+		for j := 0; j < count; j++ {
+			pos := FREE_LIST_HEADER_SIZE + j*FREE_LIST_ENTRY_SIZE
+			free := binary.LittleEndian.Uint64(node[pos:])
+			if free == uint64(constant.NilPagePtr) || free >= flushed {
+				return fmt.Errorf("bad free page %d in the free list page %d", free, ptr)
+			}
+			fl.push(free, binary.LittleEndian.Uint64(node[pos+8:]))
+		}
+		ptr = binary.LittleEndian.Uint64(node[4:])
+	}
+	return nil
+}
@@ -1,184 +1,518 @@
 package kvstore
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"os"
-	"path"
-	"syscall"
+	"hash/crc32"
+	"sync"
 	"trees/pkg/btree"
+	"trees/pkg/btree/comparator"
 	"trees/pkg/btree/constant"
+	"trees/pkg/btree/pagemanager"
+	"trees/pkg/btree/storage"
+	"trees/pkg/btree/types"
 )
 
+// Options are the settings of a database file
+type Options struct {
+	// PageSize is only used to create a new file, defaults to constant.DEFAULT_PAGE_SIZE.
+	// existing files use the page size stored in their meta page, a different nonzero value is an error.
+	PageSize int
+	// PrefixCompression turns on the prefix compression layout for the new nodes.
+	// it's recorded in the meta page and stays on for the file once turned on.
+	PrefixCompression bool
+	// Comparator is the order of the keys, defaults to comparator.Bytewise.
+	// it's recorded in the meta page, a file can only be used with the comparator it was created with.
+	Comparator *comparator.Comparator
+	// CacheSize is the memory budget in bytes of the cache of the internal nodes,
+	// shared by the transactions and the snapshots. zero disables the cache.
+	CacheSize int
+	// WAL turns on the write-ahead log mode: a commit appends its updates to a log
+	// and syncs it once, the tree pages are checkpointed to the file in the background.
+	// the log of the file at path is at path + ".wal". until Close checkpoints the log,
+	// after a crash for instance, the file can only be opened in WAL mode, which replays it.
+	WAL bool
+}
+
 type KV struct {
 	Path string // file name
 	// internals
-	fd   int
-	tree btree.BTree
-	// we use mmap to READ the underlying db file
-	// we use multiple mmap "chunks" (different mmap calls each) instead of
-	// a single one that we grow with mremap because mremap can potentially change
-	// the address of the memory region, which would invalidate the pointers
-	// and hinder concurrent readers
-	mmap struct {
-		// mmap size, can be larger than the file size
-		// sum of all mmap chunks sizes
-		totalSizeBytes int
-		chunks         [][]byte // multiple mmaps, can be non-continuous
-	}
-	// we use pages to WRITE to the underlying db file
-	// remember that the btree is implemented using copy-on-write, so any modification
-	// results in new nodes/pages being created: everytime btree calls 'new',
-	// to create a new node, it gets appended to temp and eventually flushed to disk
-	pages struct {
-		flushed uint64   // database size in number of pages
-		temp    [][]byte // newly allocated pages
+	// the pages of the file, the meta page aside
+	pages *pagemanager.OnDisk
+	// the cache of the internal nodes, nil if disabled
+	cache *pagemanager.Cache
+	tree  *btree.BTree
+	// page size in bytes, chosen when the file is created and stored in the meta page
+	pageSize int
+	// order of the keys
+	cmp *comparator.Comparator
+	// the meta page flags
+	flags uint32
+	// number of updates written to the file
+	version uint64
+	// the last update failed, the file may hold the meta page of the failed version
+	failed bool
+	// the meta page slot written last
+	metaSlot int
+	// the pages freed by the updates
+	free freeList
+	// serializes the writers
+	writer sync.Mutex
+	// protects the committed version (tree root and version) and the readers
+	mu sync.Mutex
+	// the live snapshots
+	readers map[*Snapshot]struct{}
+	// the free pages freed at versions up to reuse can be reused by the running transaction
+	reuse uint64
+	// the write-ahead log, nil unless in WAL mode
+	log *wal
+	// the version of the last checkpoint in WAL mode
+	checkpointed uint64
+	// wakes up the background checkpoints, closed by Close
+	checkpoints chan struct{}
+	// closed once the background checkpoints are stopped
+	checkpointsDone chan struct{}
+}
+
+// Open opens the database file at path, creating it if it doesn't exist.
+func Open(path string, opts Options) (*KV, error) {
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+	file, err := storage.OpenOSFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var log storage.File
+	if opts.WAL {
+		if log, err = storage.OpenOSFile(path + ".wal"); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
 	}
+	db, err := openFiles(file, log, opts)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	db.Path = path
+	return db, nil
 }
 
-// KV is a wrapper around a BTree which first updates the in-memory BTree structs,
-// and then writes the changes to the file.
-func (db *KV) Get(key []byte) ([]byte, bool) {
-	return db.tree.Get(key)
+// OpenFile opens a database stored in file, which can be empty.
+// the KV owns the file from then on, it's closed by Close or when OpenFile fails.
+// the WAL mode needs a log file, see OpenFileWithLog.
+func OpenFile(file storage.File, opts Options) (*KV, error) {
+	if opts.WAL {
+		_ = file.Close()
+		return nil, fmt.Errorf("the WAL mode needs a log file")
+	}
+	return openFiles(file, nil, opts)
 }
-func (db *KV) Set(key []byte, val []byte) error {
-	db.tree.Insert(key, val)
-	return updateFile(db)
+
+// OpenFileWithLog opens a database stored in file in WAL mode, with its write-ahead log in log.
+// both can be empty, and are owned by the KV from then on, like with OpenFile.
+func OpenFileWithLog(file storage.File, log storage.File, opts Options) (*KV, error) {
+	opts.WAL = true
+	return openFiles(file, log, opts)
 }
-func (db *KV) Del(key []byte) (bool, error) {
-	deleted := db.tree.Delete(key)
-	return deleted, updateFile(db)
+
+// the log is nil unless opts.WAL is set
+func openFiles(file storage.File, log storage.File, opts Options) (*KV, error) {
+	closeLogFile := func() {
+		if log != nil {
+			_ = log.Close()
+		}
+	}
+	if err := opts.check(); err != nil {
+		_ = file.Close()
+		closeLogFile()
+		return nil, err
+	}
+	if opts.Comparator == nil {
+		opts.Comparator = comparator.Bytewise
+	}
+	db := &KV{cmp: opts.Comparator, readers: map[*Snapshot]struct{}{}}
+	err := db.load(file, opts)
+	if err == nil && log != nil {
+		err = db.openLog(log)
+	}
+	if err != nil {
+		if db.pages != nil {
+			_ = db.pages.Close()
+		} else {
+			_ = file.Close()
+		}
+		closeLogFile()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (opts *Options) check() error {
+	if opts.PageSize != 0 && !constant.ValidPageSize(opts.PageSize) {
+		return fmt.Errorf("invalid page size %d", opts.PageSize)
+	}
+	if opts.Comparator != nil && len(opts.Comparator.Name) > comparator.MAX_NAME_SIZE {
+		return fmt.Errorf("comparator name %q is too long", opts.Comparator.Name)
+	}
+	if opts.CacheSize < 0 {
+		return fmt.Errorf("negative cache size %d", opts.CacheSize)
+	}
+	return nil
 }
 
-func updateFile(db *KV) error {
-	// 1. Write new nodes.
-	if err := writePages(db); err != nil {
+// read the meta page of the file, and map its pages
+func (db *KV) load(file storage.File, opts Options) (err error) {
+	defer pagemanager.RecoverCorruption(&err)
+	fileSize, err := file.Size()
+	if err != nil {
 		return err
 	}
-	// 2. `fsync` to enforce the order between 1 and 3.
-	if err := syscall.Fsync(db.fd); err != nil {
+	meta := metaPage{flushed: 1, pageSize: opts.PageSize, freeHead: uint64(constant.NilPagePtr)}
+	if fileSize == 0 { // empty file, the meta page of an empty tree is written below
+		if meta.pageSize == 0 {
+			meta.pageSize = constant.DEFAULT_PAGE_SIZE
+		}
+	} else {
+		if meta, err = readMeta(file, fileSize); err != nil {
+			return err
+		}
+		if meta.comparator != db.cmp.Name {
+			return fmt.Errorf("the file keys are ordered by the %q comparator, not %q", meta.comparator, db.cmp.Name)
+		}
+	}
+	if opts.PageSize != 0 && opts.PageSize != meta.pageSize {
+		return fmt.Errorf("the file page size is %d, not %d", meta.pageSize, opts.PageSize)
+	}
+	if meta.flags&META_FLAG_WAL != 0 && !opts.WAL {
+		return fmt.Errorf("the file was last used in WAL mode, its log must be replayed")
+	}
+	db.pageSize, db.flags, db.version, db.metaSlot = meta.pageSize, meta.flags, meta.version, meta.slot
+	if opts.PrefixCompression {
+		db.flags |= META_FLAG_PREFIX_COMPRESSION
+	}
+	if db.flags&META_FLAG_PREFIX_COMPRESSION != 0 && !db.cmp.PrefixContiguous {
+		return fmt.Errorf("prefix compression requires a prefix contiguous comparator")
+	}
+
+	if db.pages, err = pagemanager.NewOnDisk(file, db.pageSize, meta.flushed); err != nil {
 		return err
 	}
-	// 3. Update the root pointer atomically.
-	if err := writeMetaPage(db); err != nil {
+	db.pages.Reuse = func() (types.PagePtr, bool) {
+		ptr, ok := db.free.pop(db.reuse)
+		return types.PagePtr(ptr), ok
+	}
+	db.pages.Free = func(ptr types.PagePtr) {
+		db.free.push(uint64(ptr), db.version+1)
+	}
+	if err := db.free.load(db, meta.freeHead); err != nil {
 		return err
 	}
-	// 4. `fsync` to make everything persistent.
-	return syscall.Fsync(db.fd)
+	var pages pagemanager.PageManager = db.pages
+	if opts.CacheSize > 0 {
+		db.cache = pagemanager.NewCache(db.pages, opts.CacheSize)
+		pages = db.cache
+	}
+	db.tree = btree.New(pages, btree.Options{
+		PageSize:          db.pageSize,
+		PrefixCompression: db.flags&META_FLAG_PREFIX_COMPRESSION != 0,
+		Comparator:        db.cmp,
+	})
+	db.tree.RootPtr = meta.root
+	if fileSize == 0 {
+		return initMeta(db)
+	}
+	return nil
 }
 
-func createFileSync(file string) (int, error) {
-	// obtain the directory fd
-	dirflags := os.O_RDONLY | syscall.O_DIRECTORY
-	dirfd, err := syscall.Open(path.Dir(file), dirflags, 0o644)
-	if err != nil {
-		return -1, fmt.Errorf("open directory: %w", err)
+// CacheStats returns the counters of the cache of the internal nodes, they are zero if it's disabled.
+func (db *KV) CacheStats() pagemanager.CacheStats {
+	if db.cache == nil {
+		return pagemanager.CacheStats{}
 	}
-	defer syscall.Close(dirfd)
+	return db.cache.Stats()
+}
 
-	// open or create the file
-	flags := os.O_RDWR | os.O_CREATE
-	err = syscall.Chdir(path.Dir(file)) // change the working directory
-	if err != nil {
-		return -1, fmt.Errorf("chdir: %w", err)
-	}
-	fd, err := syscall.Open(path.Base(file), flags, 0o644)
-	if err != nil {
-		return -1, fmt.Errorf("open file: %w", err)
+// Close unmaps and closes the file. the KV can't be used afterwards.
+// in WAL mode, the log is checkpointed first.
+func (db *KV) Close() error {
+	if db.log == nil {
+		return db.pages.Close()
 	}
-	// fsync the directory
-	if err = syscall.Fsync(dirfd); err != nil {
-		_ = syscall.Close(fd) // may leave an empty file
-		return -1, fmt.Errorf("fsync directory: %w", err)
+	return errors.Join(db.closeLog(), db.pages.Close())
+}
+
+// KV is a wrapper around a BTree which first updates the in-memory BTree structs,
+// and then writes the changes to the file.
+// the reads see the last committed transaction, through a short lived snapshot,
+// use Snapshot for consistent reads across several calls or for cursors.
+// they return a *CorruptionError when a page of the file is corrupted.
+func (db *KV) Get(key []byte) ([]byte, bool, error) {
+	snap := db.Snapshot()
+	defer snap.Release()
+	val, ok, err := snap.Get(key)
+	// the page holding the value may be reused once the snapshot is released
+	return bytes.Clone(val), ok, err
+}
+
+// Scan calls fn on every KV with start <= key < end, until fn returns false.
+// A nil end means that there is no upper bound.
+// the keys and values are only valid during the call to fn.
+func (db *KV) Scan(start []byte, end []byte, fn func(key []byte, val []byte) bool) error {
+	snap := db.Snapshot()
+	defer snap.Release()
+	return snap.Scan(start, end, fn)
+}
+
+// ScanPrefix calls fn on every KV whose key starts with prefix, until fn returns false.
+// the keys and values are only valid during the call to fn.
+func (db *KV) ScanPrefix(prefix []byte, fn func(key []byte, val []byte) bool) error {
+	snap := db.Snapshot()
+	defer snap.Release()
+	return snap.ScanPrefix(prefix, fn)
+}
+
+// Set inserts or updates a key in its own transaction.
+func (db *KV) Set(key []byte, val []byte) error {
+	tx := db.Begin()
+	if err := tx.Set(key, val); err != nil {
+		tx.Abort()
+		return err
 	}
-	return fd, nil
+	return tx.Commit()
 }
 
-// maybeCreateNewMmapChunk extends the mmap region by creating a new chunk, if needed.
-// the new chunk is at least 64 MB, and otherwise a power of 2 of the current total size.
-func maybeCreateNewMmapChunk(db *KV, size int) error {
-	if size <= db.mmap.totalSizeBytes {
-		return nil // enough range
+// Del deletes a key in its own transaction, and reports whether it existed.
+func (db *KV) Del(key []byte) (bool, error) {
+	tx := db.Begin()
+	deleted, err := tx.Del(key)
+	if err != nil {
+		tx.Abort()
+		return false, err
 	}
-	newMmapLen := max(db.mmap.totalSizeBytes, 64<<20)
-	for db.mmap.totalSizeBytes+newMmapLen < size {
-		newMmapLen *= 2 // still not enough?
+	return deleted, tx.Commit()
+}
+
+// updateFile commits a new version whose tree root is root
+func updateFile(db *KV, root types.PagePtr) error {
+	if err := recoverFailedUpdate(db); err != nil {
+		return err
 	}
-	chunk, err := syscall.Mmap(
-		db.fd, int64(db.mmap.totalSizeBytes), newMmapLen,
-		syscall.PROT_READ, syscall.MAP_SHARED, // read-only
-	)
+	// the free list is written with the new nodes
+	db.free.save(db, db.version+1)
+	err := db.pages.Commit(func(file storage.File) error {
+		return writeMetaPage(db, file, root, db.version+1)
+	})
 	if err != nil {
-		return fmt.Errorf("mmap: %w", err)
+		db.failed = true
+		return err
 	}
-	db.mmap.totalSizeBytes += newMmapLen
-	db.mmap.chunks = append(db.mmap.chunks, chunk)
+	db.metaSlot = 1 - db.metaSlot
+	db.publish(root, db.version+1)
 	return nil
 }
 
-func (db *KV) pageAppend(node []byte) uint64 {
-	ptr := db.pages.flushed + uint64(len(db.pages.temp)) // just append
-	db.pages.temp = append(db.pages.temp, node)
-	return ptr
+// 5. publish the new version to the readers.
+func (db *KV) publish(root types.PagePtr, version uint64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.tree.RootPtr = root
+	db.version = version
 }
 
-func writePages(db *KV) error {
-	// extend the mmap if needed
-	size := (int(db.pages.flushed) + len(db.pages.temp)) * constant.BTREE_PAGE_SIZE
-	if err := maybeCreateNewMmapChunk(db, size); err != nil {
-		return err
+// a failed update may have written its meta page, which can still reach the disk,
+// but its pages are about to be overwritten by the next update.
+// overwrite that slot with the current version first, and make it persistent.
+// the new pages must stay in memory until then.
+func recoverFailedUpdate(db *KV) error {
+	if !db.failed {
+		return nil
 	}
-	// write data pages to the file
-	offset := int64(db.pages.flushed * constant.BTREE_PAGE_SIZE)
-	for _, tempPage := range db.pages.temp {
-		n, err := syscall.Pwrite(db.fd, tempPage, offset)
-		if err != nil {
-			return err
-		}
-		if n != len(tempPage) {
-			return fmt.Errorf("incomplete write: wrote %d bytes instead of %d", n, len(tempPage))
-		}
-		offset += int64(n)
+	err := db.pages.WriteMeta(func(file storage.File) error {
+		return writeMetaPage(db, file, db.tree.RootPtr, db.version)
+	})
+	if err != nil {
+		return err
 	}
-
-	// discard in-memory data
-	db.pages.flushed += uint64(len(db.pages.temp))
-	db.pages.temp = db.pages.temp[:0]
+	db.metaSlot = 1 - db.metaSlot
+	db.failed = false
 	return nil
 }
 
+// the free pages freed at versions up to the threshold can be reused:
+// they aren't part of the last committed version, nor of the versions of the live snapshots.
+func (db *KV) reuseThreshold() uint64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	threshold := db.version
+	for snap := range db.readers {
+		threshold = min(threshold, snap.version)
+	}
+	if db.log != nil {
+		// a crash goes back to the last checkpoint, its pages can't be overwritten
+		threshold = min(threshold, db.checkpointed)
+	}
+	return threshold
+}
+
 // META PAGE STUFF
-const DB_SIG = "BuildYourOwnDB06" // not compatible between chapters
+// the signature is bumped on every change of the file format, the files of the other formats are rejected.
+// 07: 4 bytes node offsets, overflow values, prefix compression, 2 meta slots and page checksums.
+const DB_SIG = "BuildYourOwnDB07"
+
+// size of the meta page content
+const META_SIZE = 92
+
+// the meta page holds 2 slots, written alternately.
+// a torn write of a slot leaves the other one, with the previous version, intact.
+const META_SLOT_SIZE = 512
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// META_FLAG_PREFIX_COMPRESSION is set once the file has nodes using the prefix compression layout
+const META_FLAG_PREFIX_COMPRESSION = 1 << 0
+
+// META_FLAG_WAL is set while the file is used in WAL mode: the log may hold versions newer than the meta page.
+// it's cleared by the checkpoint of Close.
+const META_FLAG_WAL = 1 << 1
 
-// | sig | root_ptr | page_used |
-// | 16B |    8B    |     8B    |
-func serializeMeta(db *KV) []byte {
-	var data [32]byte
+// | sig | root_ptr | page_used | page_size | comparator | flags | version | free_list | checksum |
+// | 16B |    8B    |     8B    |     4B    |    32B     |   4B  |    8B   |     8B    |    4B    |
+// the comparator name is zero padded.
+// the version is the sequence number of the slots, the checksum is the CRC32C of the previous fields.
+func serializeMeta(meta metaPage) []byte {
+	var data [META_SIZE]byte
 	copy(data[:16], []byte(DB_SIG))
-	binary.LittleEndian.PutUint64(data[16:], uint64(db.tree.RootPtr))
-	binary.LittleEndian.PutUint64(data[24:], db.pages.flushed)
+	binary.LittleEndian.PutUint64(data[16:], uint64(meta.root))
+	binary.LittleEndian.PutUint64(data[24:], meta.flushed)
+	binary.LittleEndian.PutUint32(data[32:], uint32(meta.pageSize))
+	copy(data[36:68], meta.comparator)
+	binary.LittleEndian.PutUint32(data[68:], meta.flags)
+	binary.LittleEndian.PutUint64(data[72:], meta.version)
+	binary.LittleEndian.PutUint64(data[80:], meta.freeHead)
+	binary.LittleEndian.PutUint32(data[88:], crc32.Checksum(data[:88], crcTable))
 	return data[:]
 }
 
-func loadMeta(db *KV, data []byte)
+// the meta page of a version of the file whose tree root is root
+func (db *KV) meta(root types.PagePtr, version uint64) metaPage {
+	return metaPage{
+		root:       root,
+		flushed:    db.pages.Flushed(),
+		pageSize:   db.pageSize,
+		comparator: db.cmp.Name,
+		flags:      db.flags,
+		version:    version,
+		freeHead:   db.free.head(),
+	}
+}
 
-func readRoot(db *KV, fileSize int64) error {
-	if fileSize == 0 { // empty file
-		db.pages.flushed = 1 // the meta page is initialized on the 1st write
-		return nil
+// metaSlot returns the content and the index of the valid slot with the newest version, if any
+func metaSlot(data []byte, fileSize int64) ([]byte, int, bool) {
+	var newest []byte
+	newestSlot := 0
+	for slot := 0; slot < 2; slot++ {
+		offset := slot * META_SLOT_SIZE
+		if fileSize < int64(offset+META_SIZE) {
+			break // the slot was never written
+		}
+		meta := data[offset : offset+META_SIZE]
+		if string(meta[:16]) != DB_SIG || crc32.Checksum(meta[:88], crcTable) != binary.LittleEndian.Uint32(meta[88:]) {
+			continue // never written, or torn write
+		}
+		if newest == nil || binary.LittleEndian.Uint64(meta[72:]) > binary.LittleEndian.Uint64(newest[72:]) {
+			newest, newestSlot = meta, slot
+		}
 	}
-	// read the page
-	data := db.mmap.chunks[0]
-	loadMeta(db, data)
-	// verify the page
-	// ...
-	return nil
+	return newest, newestSlot, newest != nil
 }
 
-// 3. Update the meta page. it must be atomic.
-func writeMetaPage(db *KV) error {
-	if _, err := syscall.Pwrite(db.fd, serializeMeta(db), 0); err != nil {
+// metaPage is the content of a meta page
+type metaPage struct {
+	root       types.PagePtr
+	flushed    uint64
+	pageSize   int
+	comparator string
+	flags      uint32
+	version    uint64
+	freeHead   uint64
+	// the slot it was read from
+	slot int
+}
+
+// readMeta reads and validates the meta page of a file of fileSize bytes
+func readMeta(file storage.File, fileSize int64) (metaPage, error) {
+	if fileSize < META_SIZE {
+		return metaPage{}, fmt.Errorf("truncated meta page: the file is only %d bytes", fileSize)
+	}
+	mapping, err := file.Map(0, 2*META_SLOT_SIZE)
+	if err != nil {
+		return metaPage{}, err
+	}
+	defer file.Unmap(mapping)
+	return parseMeta(mapping, fileSize)
+}
+
+func parseMeta(data []byte, fileSize int64) (metaPage, error) {
+	slotData, slot, ok := metaSlot(data, fileSize)
+	if !ok {
+		// the files of the older formats start with an older signature
+		if sig := string(data[:16]); sig != DB_SIG && sig[:14] == DB_SIG[:14] {
+			return metaPage{}, fmt.Errorf("unsupported file format %q, expected %q", sig, DB_SIG)
+		}
+		return metaPage{}, fmt.Errorf("no valid meta page: bad signature or checksum, not a database file")
+	}
+	data = slotData
+	meta := metaPage{
+		root:       types.PagePtr(binary.LittleEndian.Uint64(data[16:])),
+		flushed:    binary.LittleEndian.Uint64(data[24:]),
+		pageSize:   int(binary.LittleEndian.Uint32(data[32:])),
+		comparator: string(bytes.TrimRight(data[36:68], "\x00")),
+		flags:      binary.LittleEndian.Uint32(data[68:]),
+		version:    binary.LittleEndian.Uint64(data[72:]),
+		freeHead:   binary.LittleEndian.Uint64(data[80:]),
+		slot:       slot,
+	}
+	if !constant.ValidPageSize(meta.pageSize) {
+		return metaPage{}, fmt.Errorf("bad page size %d in the meta page", meta.pageSize)
+	}
+	// the meta page is the 1st page, it's the only one when the tree is empty
+	if meta.flushed < 1 || (meta.flushed > 1 && uint64(fileSize) < meta.flushed*uint64(meta.pageSize)) {
+		return metaPage{}, fmt.Errorf("bad page count %d for a file of %d bytes", meta.flushed, fileSize)
+	}
+	if meta.root != constant.NilPagePtr && uint64(meta.root) >= meta.flushed {
+		return metaPage{}, fmt.Errorf("root pointer %d out of the %d pages", meta.root, meta.flushed)
+	}
+	if meta.flags&^(META_FLAG_PREFIX_COMPRESSION|META_FLAG_WAL) != 0 {
+		return metaPage{}, fmt.Errorf("unknown meta flags %#x", meta.flags)
+	}
+	return meta, nil
+}
+
+// initMeta writes the meta page of an empty tree at version 0 into a new file, and makes it durable,
+// so that a crash during the 1st update leaves an empty database rather than a file without meta page.
+func initMeta(db *KV) error {
+	return db.pages.WriteMeta(func(file storage.File) error {
+		if _, err := file.WriteAt(serializeMeta(db.meta(constant.NilPagePtr, 0)), metaSlotOffset(db.metaSlot)); err != nil {
+			return fmt.Errorf("write meta page: %w", err)
+		}
+		return nil
+	})
+}
+
+// 3. Update the meta page, in the slot that wasn't written last.
+// the slot of the previous version is left untouched, in case the write is torn.
+// the caller switches db.metaSlot once the write is durable.
+func writeMetaPage(db *KV, file storage.File, root types.PagePtr, version uint64) error {
+	if _, err := file.WriteAt(serializeMeta(db.meta(root, version)), metaSlotOffset(1-db.metaSlot)); err != nil {
 		return fmt.Errorf("write meta page: %w", err)
 	}
 	return nil
 }
+
+// the offset of a meta page slot
+func metaSlotOffset(slot int) int64 {
+	return int64(slot) * META_SLOT_SIZE
+}
@@ -0,0 +1,312 @@
+package kvstore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+	"trees/pkg/btree/comparator"
+	"trees/pkg/btree/constant"
+
+	"github.com/stretchr/testify/require"
+)
+
+// getter is a KV, a snapshot or a transaction
+type getter interface {
+	Get(key []byte) ([]byte, bool, error)
+}
+
+func mustGet(t *testing.T, g getter, key string) ([]byte, bool) {
+	t.Helper()
+	val, ok, err := g.Get([]byte(key))
+	require.NoError(t, err)
+	return val, ok
+}
+
+func mustDel(t *testing.T, tx *KVTX, key string) bool {
+	t.Helper()
+	deleted, err := tx.Del([]byte(key))
+	require.NoError(t, err)
+	return deleted
+}
+
+func TestOpenClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	require.NoError(t, err)
+	_, ok := mustGet(t, db, "k")
+	require.False(t, ok)
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, db.Set([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("val-%d", i))))
+	}
+	deleted, err := db.Del([]byte("key-0000"))
+	require.NoError(t, err)
+	require.True(t, deleted)
+	require.NoError(t, db.Close())
+
+	db, err = Open(path, Options{})
+	require.NoError(t, err)
+	defer db.Close()
+	_, ok = mustGet(t, db, "key-0000")
+	require.False(t, ok)
+	for i := 1; i < 1000; i++ {
+		val, ok := mustGet(t, db, fmt.Sprintf("key-%04d", i))
+		require.True(t, ok)
+		require.Equal(t, fmt.Sprintf("val-%d", i), string(val))
+	}
+	require.NoError(t, db.Set([]byte("new"), []byte("v")))
+	val, ok := mustGet(t, db, "new")
+	require.True(t, ok)
+	require.Equal(t, "v", string(val))
+}
+
+func TestOpenOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{PageSize: 8192, PrefixCompression: true, Comparator: comparator.Reverse})
+	require.NoError(t, err)
+	require.NoError(t, db.Set([]byte("a"), []byte("1")))
+	require.NoError(t, db.Close())
+
+	_, err = Open(path, Options{Comparator: comparator.Reverse, PageSize: 4096})
+	require.ErrorContains(t, err, "page size")
+	_, err = Open(path, Options{})
+	require.ErrorContains(t, err, "comparator")
+
+	// the page size and the prefix compression come from the meta page
+	db, err = Open(path, Options{Comparator: comparator.Reverse})
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, 8192, db.tree.PageSize())
+	require.NotZero(t, db.flags&META_FLAG_PREFIX_COMPRESSION)
+}
+
+func TestOpenCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	db, err := Open(path, Options{})
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Set([]byte(fmt.Sprintf("key-%04d", i)), []byte("val")))
+	}
+	require.NoError(t, db.Close())
+	good, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	// corrupt a field of both meta slots, keeping their checksums valid
+	field := func(offset int, b byte) func(data []byte) []byte {
+		return func(data []byte) []byte {
+			for slot := 0; slot < 2; slot++ {
+				meta := data[slot*META_SLOT_SIZE : slot*META_SLOT_SIZE+META_SIZE]
+				meta[offset] = b
+				binary.LittleEndian.PutUint32(meta[88:], crc32.Checksum(meta[:88], crcTable))
+			}
+			return data
+		}
+	}
+	for _, tc := range []struct {
+		name    string
+		corrupt func(data []byte) []byte
+		err     string
+	}{
+		{"signature", func(data []byte) []byte { data[0] ^= 0xff; data[META_SLOT_SIZE] ^= 0xff; return data }, "signature"},
+		{"checksum", func(data []byte) []byte { data[20] ^= 0xff; data[META_SLOT_SIZE+20] ^= 0xff; return data }, "checksum"},
+		{"older format", field(15, '6'), `unsupported file format "BuildYourOwnDB06"`},
+		{"truncated meta", func(data []byte) []byte { return data[:20] }, "truncated"},
+		{"truncated pages", func(data []byte) []byte { return data[:2*constant.DEFAULT_PAGE_SIZE] }, "page count"},
+		{"page size", field(32, 1), "page size"},
+		{"root", field(16+7, 1), "root pointer"},
+		{"flags", field(68, 0x80), "flags"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, tc.name+".db")
+			require.NoError(t, os.WriteFile(path, tc.corrupt(append([]byte(nil), good...)), 0o644))
+			_, err := Open(path, Options{})
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestMetaSlots(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	db, err := Open(path, Options{})
+	require.NoError(t, err)
+	for i := 0; i < 11; i++ {
+		require.NoError(t, db.Set([]byte(fmt.Sprintf("key-%04d", i)), []byte("val")))
+	}
+	require.NoError(t, db.Close())
+	good, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	count := func(db *KV) int {
+		n := 0
+		require.NoError(t, db.Scan(nil, nil, func(key []byte, val []byte) bool {
+			n++
+			return true
+		}))
+		return n
+	}
+	// version 11 is in the odd slot, a torn write of it falls back to version 10
+	for _, torn := range []int{16, 24, 80, 90} {
+		t.Run(fmt.Sprintf("torn at %d", torn), func(t *testing.T) {
+			data := append([]byte(nil), good...)
+			for i := META_SLOT_SIZE + torn; i < META_SLOT_SIZE+META_SIZE; i++ {
+				data[i] = 0xab
+			}
+			path := filepath.Join(dir, fmt.Sprintf("torn%d.db", torn))
+			require.NoError(t, os.WriteFile(path, data, 0o644))
+			db, err := Open(path, Options{})
+			require.NoError(t, err)
+			defer db.Close()
+			require.Equal(t, uint64(10), db.version)
+			require.Equal(t, 10, count(db))
+			// the next version overwrites the torn slot
+			require.NoError(t, db.Set([]byte("new"), []byte("val")))
+			require.Equal(t, uint64(11), db.version)
+		})
+	}
+}
+
+func TestBuild(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	i := 0
+	next := func() ([]byte, []byte, bool) {
+		if i == 20000 {
+			return nil, nil, false
+		}
+		i++
+		return []byte(fmt.Sprintf("key-%06d", i)), []byte(fmt.Sprintf("val-%d", i)), true
+	}
+	require.NoError(t, Build(path, BuildOptions{FillFactor: 0.8}, next))
+	require.Error(t, Build(path, BuildOptions{}, next), "the file is not empty")
+
+	db, err := Open(path, Options{})
+	require.NoError(t, err)
+	defer db.Close()
+	n := 0
+	require.NoError(t, db.Scan(nil, nil, func(key []byte, val []byte) bool {
+		n++
+		require.Equal(t, fmt.Sprintf("key-%06d", n), string(key))
+		require.Equal(t, fmt.Sprintf("val-%d", n), string(val))
+		return true
+	}))
+	require.Equal(t, 20000, n)
+	require.NoError(t, db.Set([]byte("key-000000"), []byte("first")))
+	val, ok := mustGet(t, db, "key-000000")
+	require.True(t, ok)
+	require.Equal(t, "first", string(val))
+
+	t.Run("failed", func(t *testing.T) {
+		dir := t.TempDir()
+		// an out of order key once some pages are written
+		unordered := func() func() ([]byte, []byte, bool) {
+			i := 0
+			return func() ([]byte, []byte, bool) {
+				i++
+				if i == 200000 {
+					return []byte("key-000000"), []byte("val"), true
+				}
+				return []byte(fmt.Sprintf("key-%06d", i)), []byte("val"), true
+			}
+		}
+		path := filepath.Join(dir, "missing.db")
+		require.ErrorContains(t, Build(path, BuildOptions{}, unordered()), "is not greater")
+		empty := filepath.Join(dir, "empty.db")
+		require.NoError(t, os.WriteFile(empty, nil, 0o644))
+		require.ErrorContains(t, Build(empty, BuildOptions{}, unordered()), "is not greater")
+		// the files are untouched, and the temporary ones are removed
+		_, err := os.Stat(path)
+		require.True(t, os.IsNotExist(err))
+		require.Zero(t, fileSize(t, empty))
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+
+		// the build can be retried
+		i = 0
+		require.NoError(t, Build(path, BuildOptions{}, next))
+		db, err := Open(path, Options{})
+		require.NoError(t, err)
+		defer db.Close()
+		val, ok := mustGet(t, db, "key-020000")
+		require.True(t, ok)
+		require.Equal(t, "val-20000", string(val))
+	})
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	return info.Size()
+}
+
+func TestFreeList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	require.NoError(t, err)
+	churn := func(round int) {
+		for i := 0; i < 500; i++ {
+			key := []byte(fmt.Sprintf("key-%03d", i%100))
+			require.NoError(t, db.Set(key, []byte(fmt.Sprintf("val-%d-%d", round, i))))
+		}
+	}
+	churn(0)
+	size := fileSize(t, path)
+	for round := 1; round < 10; round++ {
+		churn(round)
+	}
+	require.Equal(t, size, fileSize(t, path), "the freed pages are reused")
+
+	// the free list survives a reopen
+	require.NoError(t, db.Close())
+	db, err = Open(path, Options{})
+	require.NoError(t, err)
+	defer db.Close()
+	require.NotEmpty(t, db.free.entries)
+	churn(10)
+	require.Equal(t, size, fileSize(t, path))
+	for i := 0; i < 100; i++ {
+		val, ok := mustGet(t, db, fmt.Sprintf("key-%03d", i))
+		require.True(t, ok)
+		require.Equal(t, fmt.Sprintf("val-10-%d", 400+i), string(val))
+	}
+}
+
+func TestFreeListPages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	i := 0
+	next := func() ([]byte, []byte, bool) {
+		i++
+		return []byte(fmt.Sprintf("key-%06d", i)), make([]byte, 100), i <= 20000
+	}
+	require.NoError(t, Build(path, BuildOptions{}, next))
+	db, err := Open(path, Options{})
+	require.NoError(t, err)
+	// deleting every other key in a single update frees most of the pages
+	tx := db.Begin()
+	for i := 1; i <= 20000; i += 2 {
+		mustDel(t, tx, fmt.Sprintf("key-%06d", i))
+	}
+	require.NoError(t, tx.Commit())
+	entries := len(db.free.entries)
+	require.Greater(t, len(db.free.pages), 1, "the free list spans multiple pages")
+	require.NoError(t, db.Close())
+
+	db, err = Open(path, Options{})
+	require.NoError(t, err)
+	defer db.Close()
+	require.Len(t, db.free.entries, entries)
+	for i := 2; i <= 20000; i += 2 {
+		_, ok := mustGet(t, db, fmt.Sprintf("key-%06d", i))
+		require.True(t, ok)
+	}
+	// the new pages come from the free list
+	size := fileSize(t, path)
+	for i := 1; i <= 2000; i += 2 {
+		require.NoError(t, db.Set([]byte(fmt.Sprintf("key-%06d", i)), make([]byte, 100)))
+	}
+	require.Equal(t, size, fileSize(t, path))
+}
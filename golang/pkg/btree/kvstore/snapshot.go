@@ -0,0 +1,71 @@
+package kvstore
+
+import (
+	"trees/internal/errors"
+	"trees/pkg/btree"
+)
+
+// Snapshot is a read-only view of the KVs at the time it was taken.
+// it can be used from many goroutines, while a writer commits new versions.
+// the pages it references are not reused until it's released,
+// and the keys and values it returns are only valid until then.
+type Snapshot struct {
+	db   *KV
+	tree *btree.BTree
+	// the version of the tree
+	version  uint64
+	released bool
+}
+
+// Snapshot takes a snapshot of the last committed version, it must be released with Release.
+func (db *KV) Snapshot() *Snapshot {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	pages := db.pages.Reader()
+	if db.cache != nil {
+		// the pages are only reused once no snapshot can read them, they are dropped from the cache by then
+		pages = db.cache.View(pages)
+	}
+	tree := btree.New(pages, btree.Options{PageSize: db.pageSize, Comparator: db.cmp})
+	tree.RootPtr = db.tree.RootPtr
+	snap := &Snapshot{db: db, tree: tree, version: db.version}
+	db.readers[snap] = struct{}{}
+	return snap
+}
+
+// Release unpins the snapshot, it can't be used afterwards.
+func (snap *Snapshot) Release() {
+	snap.db.mu.Lock()
+	defer snap.db.mu.Unlock()
+	errors.Assert(!snap.released, "the snapshot is already released")
+	snap.released = true
+	delete(snap.db.readers, snap)
+}
+
+// Version returns the number of transactions committed before the snapshot.
+func (snap *Snapshot) Version() uint64 {
+	return snap.version
+}
+
+// Get returns the value of a key.
+func (snap *Snapshot) Get(key []byte) (val []byte, ok bool, err error) {
+	return snap.tree.Get(key)
+}
+
+// Cursor returns a cursor over the KVs of the snapshot, in key order.
+// a cursor must only be used by a single goroutine.
+// a corrupted page stops it, see Cursor.Err.
+func (snap *Snapshot) Cursor() *btree.Cursor {
+	return snap.tree.Cursor()
+}
+
+// Scan calls fn on every KV with start <= key < end, until fn returns false.
+// A nil end means that there is no upper bound.
+func (snap *Snapshot) Scan(start []byte, end []byte, fn func(key []byte, val []byte) bool) error {
+	return snap.tree.Scan(start, end, fn)
+}
+
+// ScanPrefix calls fn on every KV whose key starts with prefix, until fn returns false.
+func (snap *Snapshot) ScanPrefix(prefix []byte, fn func(key []byte, val []byte) bool) error {
+	return snap.tree.ScanPrefix(prefix, fn)
+}
@@ -0,0 +1,132 @@
+package kvstore
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"trees/pkg/btree/constant"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	require.NoError(t, err)
+	defer db.Close()
+	set := func(round int) {
+		tx := db.Begin()
+		for i := 0; i < 200; i++ {
+			require.NoError(t, tx.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("val-%d-%d", round, i))))
+		}
+		require.NoError(t, tx.Commit())
+	}
+	check := func(snap *Snapshot, round int) {
+		for i := 0; i < 200; i++ {
+			val, ok := mustGet(t, snap, fmt.Sprintf("key-%03d", i))
+			require.True(t, ok)
+			require.Equal(t, fmt.Sprintf("val-%d-%d", round, i), string(val))
+		}
+	}
+	set(0)
+
+	snap := db.Snapshot()
+	for round := 1; round < 20; round++ {
+		set(round)
+	}
+	// the pages of the snapshot were not reused by the later versions
+	check(snap, 0)
+	size := fileSize(t, path)
+	latest := db.Snapshot()
+	check(latest, 19)
+	latest.Release()
+
+	snap.Release()
+	require.Panics(t, snap.Release)
+	for round := 20; round < 40; round++ {
+		set(round)
+	}
+	require.Equal(t, size, fileSize(t, path), "the pages are reused once the snapshot is released")
+	latest = db.Snapshot()
+	defer latest.Release()
+	check(latest, 39)
+}
+
+func TestSnapshotConcurrency(t *testing.T) {
+	t.Run("no cache", func(t *testing.T) { testSnapshotConcurrency(t, Options{}) })
+	// the transactions and the snapshots share the cache, with many evictions
+	t.Run("cache", func(t *testing.T) {
+		db := testSnapshotConcurrency(t, Options{CacheSize: 2 * constant.DEFAULT_PAGE_SIZE})
+		stats := db.CacheStats()
+		require.NotZero(t, stats.Hits)
+		require.NotZero(t, stats.Evictions)
+	})
+}
+
+func testSnapshotConcurrency(t *testing.T, opts Options) *KV {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	// every transaction updates all the keys, so a snapshot sees a single round
+	const nkeys, rounds, readers = 100, 100, 4
+	set := func(round int) {
+		tx := db.Begin()
+		for i := 0; i < nkeys; i++ {
+			// several leaves, under internal nodes
+			require.NoError(t, tx.Set([]byte(fmt.Sprintf("key-%03d-%s", i, strings.Repeat("k", 100))), []byte(fmt.Sprintf("%d", round))))
+		}
+		require.NoError(t, tx.Commit())
+	}
+	set(0)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				snap := db.Snapshot()
+				var round string
+				n := 0
+				err := snap.Scan(nil, nil, func(key []byte, val []byte) bool {
+					if n == 0 {
+						round = string(val)
+					}
+					if string(val) != round {
+						t.Errorf("snapshot %d mixes rounds %s and %s", snap.Version(), round, val)
+						return false
+					}
+					n++
+					return true
+				})
+				if err != nil {
+					t.Errorf("snapshot %d: %v", snap.Version(), err)
+				}
+				if n != nkeys {
+					t.Errorf("snapshot %d has %d keys", snap.Version(), n)
+				}
+				snap.Release()
+				// the short lived snapshots of the KV
+				if _, ok, err := db.Get([]byte("key-000-" + strings.Repeat("k", 100))); !ok || err != nil {
+					t.Errorf("key-000 not found: %v", err)
+				}
+			}
+		}()
+	}
+	for round := 1; round < rounds; round++ {
+		set(round)
+	}
+	close(done)
+	wg.Wait()
+	return db
+}
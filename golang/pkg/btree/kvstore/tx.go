@@ -0,0 +1,130 @@
+package kvstore
+
+import (
+	"bytes"
+	"slices"
+	"trees/internal/errors"
+	"trees/pkg/btree"
+)
+
+// KVTX is a read-write transaction.
+// its updates are applied to a copy of the tree, and only become visible
+// to the readers of the KV when it's committed. there is a single writer at a time,
+// and a transaction must only be used by a single goroutine.
+type KVTX struct {
+	db *KV
+	// the tree being updated, it shares the pages of the KV tree
+	tree btree.BTree
+	// the state to restore on abort
+	rollback struct {
+		flushed uint64
+		free    freeList
+	}
+	// the updates to append to the log, in WAL mode
+	ops  []walOp
+	done bool
+}
+
+// Begin starts a read-write transaction, it must be ended by Commit or Abort.
+// it waits for the running transaction to end, if any.
+func (db *KV) Begin() *KVTX {
+	db.writer.Lock()
+	// the snapshots taken during the transaction see the last committed version, which is above the threshold
+	db.reuse = db.reuseThreshold()
+	tx := &KVTX{db: db, tree: *db.tree}
+	tx.rollback.flushed = db.pages.Flushed()
+	tx.rollback.free = freeList{
+		entries: slices.Clone(db.free.entries),
+		pages:   slices.Clone(db.free.pages),
+	}
+	return tx
+}
+
+// Commit writes the updates of the transaction to the file, or to the log in WAL mode,
+// and makes them visible. the transaction is aborted if they can't be written.
+func (tx *KVTX) Commit() error {
+	errors.Assert(!tx.done, "the transaction is already ended")
+	db := tx.db
+	if tx.tree.RootPtr == db.tree.RootPtr && db.pages.Pending() == 0 {
+		tx.end()
+		return nil // read-only transaction
+	}
+	var err error
+	if db.log != nil {
+		err = commitLog(db, tx.tree.RootPtr, tx.ops)
+	} else {
+		err = updateFile(db, tx.tree.RootPtr)
+	}
+	if err != nil {
+		tx.Abort()
+		return err
+	}
+	tx.end()
+	return nil
+}
+
+// Abort discards the updates of the transaction.
+func (tx *KVTX) Abort() {
+	errors.Assert(!tx.done, "the transaction is already ended")
+	db := tx.db
+	// the new pages were never made reachable, just forget them
+	db.pages.Rollback(tx.rollback.flushed)
+	db.free = tx.rollback.free
+	tx.end()
+}
+
+func (tx *KVTX) end() {
+	tx.done = true
+	tx.db.writer.Unlock()
+}
+
+// Get returns the value of a key, including the updates of the transaction.
+func (tx *KVTX) Get(key []byte) (val []byte, ok bool, err error) {
+	return tx.tree.Get(key)
+}
+
+// Set inserts or updates a key.
+// a KV that can't be inserted is rejected with ErrEmptyKey, ErrKeyTooLarge or ErrValueTooLarge,
+// and the transaction can go on. it must be aborted after the other errors.
+func (tx *KVTX) Set(key []byte, val []byte) error {
+	errors.Assert(!tx.done, "the transaction is already ended")
+	if err := tx.tree.Insert(key, val); err != nil {
+		return err
+	}
+	if tx.db.log != nil {
+		tx.ops = append(tx.ops, walOp{key: bytes.Clone(key), val: bytes.Clone(val)})
+	}
+	return nil
+}
+
+// Del deletes a key, and reports whether it existed.
+// the transaction must be aborted if it returns an error.
+func (tx *KVTX) Del(key []byte) (bool, error) {
+	errors.Assert(!tx.done, "the transaction is already ended")
+	deleted, err := tx.tree.Delete(key)
+	if err != nil {
+		return false, err
+	}
+	if deleted && tx.db.log != nil {
+		tx.ops = append(tx.ops, walOp{del: true, key: bytes.Clone(key)})
+	}
+	return deleted, nil
+}
+
+// Cursor returns a cursor over the KVs of the transaction, in key order.
+// it's invalidated by the updates of the transaction.
+// a corrupted page stops it, see Cursor.Err.
+func (tx *KVTX) Cursor() *btree.Cursor {
+	return tx.tree.Cursor()
+}
+
+// Scan calls fn on every KV with start <= key < end, until fn returns false.
+// A nil end means that there is no upper bound.
+func (tx *KVTX) Scan(start []byte, end []byte, fn func(key []byte, val []byte) bool) error {
+	return tx.tree.Scan(start, end, fn)
+}
+
+// ScanPrefix calls fn on every KV whose key starts with prefix, until fn returns false.
+func (tx *KVTX) ScanPrefix(prefix []byte, fn func(key []byte, val []byte) bool) error {
+	return tx.tree.ScanPrefix(prefix, fn)
+}
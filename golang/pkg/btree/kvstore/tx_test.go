@@ -0,0 +1,121 @@
+package kvstore
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"trees/pkg/btree/constant"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	require.NoError(t, err)
+	require.NoError(t, db.Set([]byte("a"), []byte("1")))
+	require.NoError(t, db.Set([]byte("b"), []byte("2")))
+
+	t.Run("commit", func(t *testing.T) {
+		tx := db.Begin()
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, tx.Set([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("val-%d", i))))
+		}
+		require.True(t, mustDel(t, tx, "a"))
+		require.False(t, mustDel(t, tx, "missing"))
+		// the transaction sees its own writes, the KV doesn't
+		val, ok := mustGet(t, tx, "key-0042")
+		require.True(t, ok)
+		require.Equal(t, "val-42", string(val))
+		_, ok = mustGet(t, tx, "a")
+		require.False(t, ok)
+		_, ok = mustGet(t, db, "key-0042")
+		require.False(t, ok)
+		_, ok = mustGet(t, db, "a")
+		require.True(t, ok)
+		n := 0
+		require.NoError(t, tx.ScanPrefix([]byte("key-"), func(key []byte, val []byte) bool {
+			n++
+			return true
+		}))
+		require.Equal(t, 1000, n)
+
+		version := db.version
+		require.NoError(t, tx.Commit())
+		require.Equal(t, version+1, db.version, "a single update of the file")
+		val, ok = mustGet(t, db, "key-0042")
+		require.True(t, ok)
+		require.Equal(t, "val-42", string(val))
+		_, ok = mustGet(t, db, "a")
+		require.False(t, ok)
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		root, version, flushed, free := db.tree.RootPtr, db.version, db.pages.Flushed(), len(db.free.entries)
+		tx := db.Begin()
+		for i := 0; i < 1000; i++ {
+			mustDel(t, tx, fmt.Sprintf("key-%04d", i))
+		}
+		require.NoError(t, tx.Set([]byte("c"), []byte("3")))
+		tx.Abort()
+		require.Equal(t, root, db.tree.RootPtr)
+		require.Equal(t, version, db.version)
+		require.Equal(t, flushed, db.pages.Flushed())
+		require.Len(t, db.free.entries, free)
+		require.Zero(t, db.pages.Pending())
+		_, ok := mustGet(t, db, "c")
+		require.False(t, ok)
+		_, ok = mustGet(t, db, "key-0999")
+		require.True(t, ok)
+		// the KV is still usable
+		require.NoError(t, db.Set([]byte("c"), []byte("3")))
+	})
+
+	t.Run("read only", func(t *testing.T) {
+		version := db.version
+		tx := db.Begin()
+		_, ok := mustGet(t, tx, "b")
+		require.True(t, ok)
+		require.False(t, mustDel(t, tx, "missing"))
+		require.NoError(t, tx.Commit())
+		require.Equal(t, version, db.version, "nothing to write")
+	})
+
+	t.Run("rejected KVs", func(t *testing.T) {
+		tx := db.Begin()
+		require.ErrorIs(t, tx.Set(nil, []byte("x")), ErrEmptyKey)
+		err := tx.Set([]byte(strings.Repeat("k", constant.BTREE_MAX_KEY_SIZE)), []byte("x"))
+		require.ErrorIs(t, err, ErrKeyTooLarge)
+		// the transaction goes on
+		require.NoError(t, tx.Set([]byte("d"), []byte("4")))
+		require.NoError(t, tx.Commit())
+		_, ok := mustGet(t, db, "d")
+		require.True(t, ok)
+		require.ErrorIs(t, db.Set([]byte{}, []byte("x")), ErrEmptyKey)
+	})
+
+	t.Run("single writer", func(t *testing.T) {
+		tx := db.Begin()
+		begun := make(chan *KVTX)
+		go func() { begun <- db.Begin() }()
+		select {
+		case <-begun:
+			t.Fatal("a 2nd transaction began while the 1st one is running")
+		case <-time.After(50 * time.Millisecond):
+		}
+		tx.Abort()
+		require.Panics(t, func() { tx.Abort() })
+		(<-begun).Abort()
+	})
+
+	require.NoError(t, db.Close())
+	db, err = Open(path, Options{})
+	require.NoError(t, err)
+	defer db.Close()
+	for _, key := range []string{"b", "c", "key-0000", "key-0999"} {
+		_, ok := mustGet(t, db, key)
+		require.True(t, ok, "key %s", key)
+	}
+}
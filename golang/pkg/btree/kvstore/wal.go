@@ -0,0 +1,334 @@
+package kvstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"trees/pkg/btree/pagemanager"
+	"trees/pkg/btree/storage"
+	"trees/pkg/btree/types"
+)
+
+// WAL MODE
+// a commit writes its new pages to the file without syncing them, so that the readers can map them,
+// then appends its updates to the log, and syncs the log only. the file is synced by the checkpoints,
+// which write the meta page of the last committed version and empty the log.
+// after a crash, the file is back to the last checkpoint, and the log holds the versions committed since.
+// the pages of the last checkpoint can't be reused until the next one, see reuseThreshold.
+
+// the log is a header followed by the records of the versions committed since the checkpoint:
+// | magic | checkpoint | salt | checksum |
+// |  8B   |     8B     |  4B  |    4B    |
+// | size | checksum | version | count | count * op |
+// |  4B  |    4B    |    8B   |   4B  |            |
+// | type | klen | vlen | key | val |
+// |  1B  |  4B  |  4B  |     |     |
+// the checksums are chained: the CRC32C of a record starts from the checksum of the previous record,
+// or of the header. a record left by an older log, or written after a lost one, doesn't match.
+const WAL_MAGIC = "TreesWAL"
+
+const (
+	WAL_HEADER_SIZE        = 24
+	WAL_RECORD_HEADER_SIZE = 8
+)
+
+// the size of the log that triggers a background checkpoint
+const walCheckpointSize = 4 << 20
+
+const (
+	walOpSet = 1
+	walOpDel = 2
+)
+
+// walOp is an update of a transaction, the val of a deletion is nil
+type walOp struct {
+	del bool
+	key []byte
+	val []byte
+}
+
+// walRecord holds the updates of a committed version
+type walRecord struct {
+	version uint64
+	ops     []walOp
+}
+
+// wal appends the records to the log file
+type wal struct {
+	file storage.File
+	// the version of the last checkpoint, recorded in the header
+	checkpoint uint64
+	// the checksum of the last record, or of the header
+	checksum uint32
+	// the end of the last record
+	end int64
+	// a reset failed, the header must be written again before the next record
+	broken bool
+}
+
+// reset empties the log after a checkpoint of version checkpoint, and makes it durable.
+// a torn header makes the log empty too, which is fine: the checkpoint is already durable.
+func (w *wal) reset(checkpoint uint64) error {
+	var header [WAL_HEADER_SIZE]byte
+	copy(header[:8], WAL_MAGIC)
+	binary.LittleEndian.PutUint64(header[8:], checkpoint)
+	// the salt tells the records of this log from the records left by the previous ones
+	binary.LittleEndian.PutUint32(header[16:], rand.Uint32())
+	binary.LittleEndian.PutUint32(header[20:], crc32.Checksum(header[:20], crcTable))
+	w.checkpoint, w.broken = checkpoint, true
+	if _, err := w.file.WriteAt(header[:], 0); err != nil {
+		return fmt.Errorf("write log header: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.checksum = binary.LittleEndian.Uint32(header[20:])
+	w.end = WAL_HEADER_SIZE
+	w.broken = false
+	return nil
+}
+
+// append writes the record of version, and makes it durable.
+// when it fails, the next record overwrites it.
+func (w *wal) append(version uint64, ops []walOp) error {
+	if w.broken {
+		if err := w.reset(w.checkpoint); err != nil {
+			return err
+		}
+	}
+	record := encodeWALRecord(w.checksum, walRecord{version: version, ops: ops})
+	if _, err := w.file.WriteAt(record, w.end); err != nil {
+		return fmt.Errorf("write log record: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.checksum = binary.LittleEndian.Uint32(record[4:])
+	w.end += int64(len(record))
+	return nil
+}
+
+func encodeWALRecord(prev uint32, rec walRecord) []byte {
+	size := 12
+	for _, op := range rec.ops {
+		size += 9 + len(op.key) + len(op.val)
+	}
+	data := make([]byte, WAL_RECORD_HEADER_SIZE+size)
+	binary.LittleEndian.PutUint32(data[0:], uint32(size))
+	payload := data[WAL_RECORD_HEADER_SIZE:]
+	binary.LittleEndian.PutUint64(payload[0:], rec.version)
+	binary.LittleEndian.PutUint32(payload[8:], uint32(len(rec.ops)))
+	pos := 12
+	for _, op := range rec.ops {
+		payload[pos] = walOpSet
+		if op.del {
+			payload[pos] = walOpDel
+		}
+		binary.LittleEndian.PutUint32(payload[pos+1:], uint32(len(op.key)))
+		binary.LittleEndian.PutUint32(payload[pos+5:], uint32(len(op.val)))
+		pos += 9
+		pos += copy(payload[pos:], op.key)
+		pos += copy(payload[pos:], op.val)
+	}
+	binary.LittleEndian.PutUint32(data[4:], crc32.Update(prev, crcTable, payload))
+	return data
+}
+
+// readWAL returns the checkpoint recorded by the log header, and the records that follow it.
+// the records end at the first one that is torn, or doesn't follow the previous one.
+// a log without a valid header is empty.
+func readWAL(file storage.File) (checkpoint uint64, records []walRecord, err error) {
+	size, err := file.Size()
+	if err != nil || size < WAL_HEADER_SIZE {
+		return 0, nil, err
+	}
+	mapping, err := file.Map(0, int(size))
+	if err != nil {
+		return 0, nil, err
+	}
+	// the records outlive the mapping
+	data := bytes.Clone(mapping)
+	if err := file.Unmap(mapping); err != nil {
+		return 0, nil, err
+	}
+
+	header := data[:WAL_HEADER_SIZE]
+	if string(header[:8]) != WAL_MAGIC || crc32.Checksum(header[:20], crcTable) != binary.LittleEndian.Uint32(header[20:]) {
+		return 0, nil, nil
+	}
+	checkpoint = binary.LittleEndian.Uint64(header[8:])
+	checksum := binary.LittleEndian.Uint32(header[20:])
+	for pos := WAL_HEADER_SIZE; pos+WAL_RECORD_HEADER_SIZE <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[pos:]))
+		end := pos + WAL_RECORD_HEADER_SIZE + size
+		if end > len(data) || end < pos {
+			break
+		}
+		payload := data[pos+WAL_RECORD_HEADER_SIZE : end]
+		if crc32.Update(checksum, crcTable, payload) != binary.LittleEndian.Uint32(data[pos+4:]) {
+			break
+		}
+		rec, ok := decodeWALRecord(payload)
+		if !ok || rec.version != checkpoint+uint64(len(records))+1 {
+			break
+		}
+		records = append(records, rec)
+		checksum = binary.LittleEndian.Uint32(data[pos+4:])
+		pos = end
+	}
+	return checkpoint, records, nil
+}
+
+func decodeWALRecord(payload []byte) (walRecord, bool) {
+	if len(payload) < 12 {
+		return walRecord{}, false
+	}
+	rec := walRecord{version: binary.LittleEndian.Uint64(payload[0:])}
+	count := int(binary.LittleEndian.Uint32(payload[8:]))
+	pos := 12
+	for i := 0; i < count; i++ {
+		if pos+9 > len(payload) {
+			return walRecord{}, false
+		}
+		typ := payload[pos]
+		klen := int(binary.LittleEndian.Uint32(payload[pos+1:]))
+		vlen := int(binary.LittleEndian.Uint32(payload[pos+5:]))
+		pos += 9
+		if (typ != walOpSet && typ != walOpDel) || klen > len(payload)-pos || vlen > len(payload)-pos-klen {
+			return walRecord{}, false
+		}
+		op := walOp{del: typ == walOpDel, key: payload[pos : pos+klen]}
+		if !op.del {
+			op.val = payload[pos+klen : pos+klen+vlen]
+		}
+		rec.ops = append(rec.ops, op)
+		pos += klen + vlen
+	}
+	return rec, pos == len(payload)
+}
+
+// openLog turns on the WAL mode with the log in file: it replays the versions committed
+// since the last checkpoint, checkpoints them, and starts the background checkpoints.
+func (db *KV) openLog(file storage.File) (err error) {
+	defer pagemanager.RecoverCorruption(&err)
+	db.log = &wal{file: file}
+	db.checkpointed = db.version
+	if db.flags&META_FLAG_WAL == 0 {
+		// the file has no versions in the log, which may be left by an older use of the file.
+		// empty it before the file is marked, so that it's never replayed.
+		if err := db.log.reset(db.version); err != nil {
+			return err
+		}
+	} else {
+		checkpoint, records, err := readWAL(file)
+		if err != nil {
+			return err
+		}
+		if len(records) > 0 && checkpoint > db.version {
+			return fmt.Errorf("the log follows version %d, the file is at version %d", checkpoint, db.version)
+		}
+		for _, rec := range records {
+			if rec.version <= db.version {
+				continue // already checkpointed
+			}
+			// no reader yet, the tree is updated in place
+			db.reuse = db.reuseThreshold()
+			for _, op := range rec.ops {
+				if op.del {
+					_, err = db.tree.Delete(op.key)
+				} else {
+					err = db.tree.Insert(op.key, op.val)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			db.version = rec.version
+		}
+	}
+	db.flags |= META_FLAG_WAL
+	if err := db.checkpoint(); err != nil {
+		return err
+	}
+	db.checkpoints = make(chan struct{}, 1)
+	db.checkpointsDone = make(chan struct{})
+	go db.checkpointLoop()
+	return nil
+}
+
+// closeLog stops the background checkpoints, and checkpoints the file a last time, in normal mode.
+func (db *KV) closeLog() error {
+	close(db.checkpoints)
+	<-db.checkpointsDone
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	db.flags &^= META_FLAG_WAL
+	return errors.Join(db.checkpoint(), db.log.file.Close())
+}
+
+func (db *KV) checkpointLoop() {
+	defer close(db.checkpointsDone)
+	for range db.checkpoints {
+		// a failed checkpoint is retried by the next one, the log keeps the versions meanwhile
+		_ = db.Checkpoint()
+	}
+}
+
+// Checkpoint writes the versions committed since the last checkpoint into the file,
+// and empties the log. it's called in the background as the log grows, and by Close.
+// it does nothing unless in WAL mode.
+func (db *KV) Checkpoint() error {
+	if db.log == nil {
+		return nil
+	}
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	if db.version == db.checkpointed {
+		return nil
+	}
+	return db.checkpoint()
+}
+
+// checkpoint makes the last committed version durable in the file, and empties the log.
+// the meta page must change for its new flags to be seen: without a version to checkpoint,
+// the checkpoint creates one, with the same tree. the caller holds the writer lock.
+func (db *KV) checkpoint() error {
+	version := db.version
+	if version == db.checkpointed {
+		version++
+	}
+	db.reuse = db.reuseThreshold()
+	db.free.save(db, version+1)
+	err := db.pages.Commit(func(file storage.File) error {
+		return writeMetaPage(db, file, db.tree.RootPtr, version)
+	})
+	if err != nil {
+		return err
+	}
+	db.metaSlot = 1 - db.metaSlot
+	db.publish(db.tree.RootPtr, version)
+	db.checkpointed = version
+	return db.log.reset(version)
+}
+
+// commitLog commits a new version whose tree root is root in WAL mode, with the updates ops.
+func commitLog(db *KV, root types.PagePtr, ops []walOp) error {
+	// the readers map the new pages
+	if err := db.pages.Flush(); err != nil {
+		return err
+	}
+	if err := db.log.append(db.version+1, ops); err != nil {
+		return err
+	}
+	db.publish(root, db.version+1)
+	if db.log.end >= walCheckpointSize {
+		select {
+		case db.checkpoints <- struct{}{}:
+		default: // already requested
+		}
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"trees/pkg/btree/storage"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fileVersion reads the version of the meta page of the file at path
+func fileVersion(t *testing.T, path string) uint64 {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	meta, err := parseMeta(data, int64(len(data)))
+	require.NoError(t, err)
+	return meta.version
+}
+
+func TestWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{WAL: true})
+	require.NoError(t, err)
+	checkpoint := fileVersion(t, path)
+	require.Equal(t, db.version, checkpoint)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("val-%d", i))))
+	}
+	deleted, err := db.Del([]byte("key-000"))
+	require.NoError(t, err)
+	require.True(t, deleted)
+	want := contents(t, db)
+	require.Len(t, want, 99)
+	// the commits are in the log only
+	require.Equal(t, checkpoint, fileVersion(t, path))
+	require.Equal(t, checkpoint+101, db.version)
+	require.Greater(t, fileSize(t, path+".wal"), int64(WAL_HEADER_SIZE))
+
+	// the file is marked until it's closed
+	_, err = Open(path, Options{})
+	require.ErrorContains(t, err, "WAL mode")
+
+	require.NoError(t, db.Checkpoint())
+	require.Equal(t, db.version, fileVersion(t, path))
+	require.Equal(t, int64(WAL_HEADER_SIZE), db.log.end, "the log is empty")
+	require.NoError(t, db.Set([]byte("key-100"), []byte("val-100")))
+	want["key-100"] = "val-100"
+	require.NoError(t, db.Close())
+
+	// a file closed in WAL mode can be opened in both modes
+	db, err = Open(path, Options{})
+	require.NoError(t, err)
+	require.Equal(t, want, contents(t, db))
+	require.NoError(t, db.Set([]byte("key-101"), []byte("val-101")))
+	want["key-101"] = "val-101"
+	require.NoError(t, db.Close())
+	db, err = Open(path, Options{WAL: true})
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, want, contents(t, db))
+
+	_, err = OpenFile(storage.NewMemFile(), Options{WAL: true})
+	require.ErrorContains(t, err, "log file")
+}
+
+// TestWALReplay reopens a file and its log as they were left by a crash:
+// the file is at the last checkpoint, and the commits since are replayed from the log.
+func TestWALReplay(t *testing.T) {
+	file := storage.NewMemFile()
+	log := file.Sibling()
+	db, err := OpenFileWithLog(file, log, Options{PrefixCompression: true})
+	require.NoError(t, err)
+	rng := rand.New(rand.NewSource(1))
+	state := map[string]string{}
+	commit := func(n int) {
+		for i := 0; i < n; i++ {
+			tx := db.Begin()
+			for j := 0; j < 10; j++ {
+				key := fmt.Sprintf("key-%03d", rng.Intn(300))
+				if rng.Intn(3) == 0 {
+					_, err := tx.Del([]byte(key))
+					require.NoError(t, err)
+					delete(state, key)
+					continue
+				}
+				val := fmt.Sprintf("val-%d", rng.Int())
+				if rng.Intn(50) == 0 {
+					val = strings.Repeat("big", 3000) // overflow pages
+				}
+				require.NoError(t, tx.Set([]byte(key), []byte(val)))
+				state[key] = val
+			}
+			require.NoError(t, tx.Commit())
+		}
+	}
+	commit(200)
+	require.NoError(t, db.Checkpoint())
+	commit(200)
+	version := db.version
+
+	// the file only syncs the checkpoints, and the unsynced pages are lost
+	file.CrashAfter(0)
+	require.Error(t, db.Close())
+	file = file.Recover(rng)
+	db, err = OpenFileWithLog(file, log.Recover(rng), Options{})
+	require.NoError(t, err)
+	require.Equal(t, state, contents(t, db))
+	require.Equal(t, version, db.version)
+	require.Equal(t, version, db.checkpointed, "replayed and checkpointed")
+	require.NotZero(t, db.flags&META_FLAG_PREFIX_COMPRESSION)
+	commit(10)
+	require.NoError(t, db.Close())
+
+	// MemFile.Close keeps the content
+	db, err = OpenFile(file, Options{})
+	require.NoError(t, err)
+	require.Equal(t, state, contents(t, db))
+	require.NoError(t, db.Close())
+}
+
+// TestWALSync checks that a commit only syncs the log
+func TestWALSync(t *testing.T) {
+	file := storage.NewMemFile()
+	log := file.Sibling()
+	db, err := OpenFileWithLog(file, log, Options{})
+	require.NoError(t, err)
+	defer db.Close()
+	injected := errors.New("injected")
+	file.FailSync(0, injected)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte("val")))
+	}
+	// the failed checkpoint is retried by the next one
+	require.ErrorIs(t, db.Checkpoint(), injected)
+	require.NoError(t, db.Set([]byte("key-100"), []byte("val")))
+	require.NoError(t, db.Checkpoint())
+	require.Equal(t, db.version, db.checkpointed)
+
+	// a commit fails with the log
+	log.FailSync(0, injected)
+	require.ErrorIs(t, db.Set([]byte("key-101"), []byte("val")), injected)
+	_, ok := mustGet(t, db, "key-101")
+	require.False(t, ok)
+	require.NoError(t, db.Set([]byte("key-102"), []byte("val")))
+	require.Len(t, contents(t, db), 102)
+}
+
+// TestWALStaleLog checks that a log left by an older use of the file is not replayed
+func TestWALStaleLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{WAL: true})
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte("val")))
+	}
+	stale, err := os.ReadFile(path + ".wal")
+	require.NoError(t, err)
+	for i := 0; i < 10; i += 2 {
+		_, err := db.Del([]byte(fmt.Sprintf("key-%03d", i)))
+		require.NoError(t, err)
+	}
+	require.NoError(t, db.Close())
+
+	// the versions of the stale log follow the compacted file
+	_, err = Compact(path, Options{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), fileVersion(t, path))
+	require.NoError(t, os.WriteFile(path+".wal", stale, 0o644))
+	db, err = Open(path, Options{WAL: true})
+	require.NoError(t, err)
+	require.Len(t, contents(t, db), 5)
+	require.NoError(t, db.Close())
+}
+
+// TestWALBackgroundCheckpoint checks that the file is checkpointed as the log grows
+func TestWALBackgroundCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{WAL: true})
+	require.NoError(t, err)
+	defer db.Close()
+	checkpointed := func() uint64 {
+		db.writer.Lock()
+		defer db.writer.Unlock()
+		return db.checkpointed
+	}
+	start := checkpointed()
+	val := strings.Repeat("v", 10000)
+	for i := 0; i*len(val) < 2*walCheckpointSize; i++ {
+		require.NoError(t, db.Set([]byte(fmt.Sprintf("key-%03d", i%100)), []byte(val)))
+	}
+	require.Eventually(t, func() bool { return checkpointed() > start }, 10*time.Second, 10*time.Millisecond)
+}
+
+// BenchmarkRandomWrite commits small random writes, one per transaction
+func BenchmarkRandomWrite(b *testing.B) {
+	for _, wal := range []bool{false, true} {
+		b.Run(fmt.Sprintf("wal=%v", wal), func(b *testing.B) {
+			db, err := Open(filepath.Join(b.TempDir(), "test.db"), Options{WAL: wal})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			rng := rand.New(rand.NewSource(1))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key := fmt.Sprintf("key-%08d", rng.Intn(1_000_000))
+				if err := db.Set([]byte(key), []byte("val")); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package btree
+
+import (
+	"encoding/binary"
+	"trees/pkg/btree/bnode"
+	"trees/pkg/btree/constant"
+	"trees/pkg/btree/types"
+)
+
+// Values are stored in leaves with a 1 byte tag.
+// Small values are stored inline, right after the tag.
+// Values that don't fit in a leaf are stored in a chain of overflow pages,
+// and the leaf only holds a reference to the chain:
+// | tag=valOverflow | size | first page |
+// |       1B        |  8B  |     8B     |
+const (
+	valInline   = 1
+	valOverflow = 2
+)
+
+const overflowRefSize = 1 + 8 + 8
+
+// values larger than this are stored in overflow pages
+func (tree *BTree) maxInlineValSize() int {
+	// the stored value includes the tag, and must be strictly smaller than the max value size
+	return constant.MaxValSize(tree.pageSize) - 2
+}
+
+// encodeVal returns the bytes to store in the leaf for val,
+// allocating the overflow pages with alloc if needed.
+func (tree *BTree) encodeVal(val []byte, alloc func(node []byte) types.PagePtr) []byte {
+	if len(val) <= tree.maxInlineValSize() {
+		return append([]byte{valInline}, val...)
+	}
+	// allocate the chain from its end, so that each page knows its next page
+	next := constant.NilPagePtr
+	capacity := bnode.OverflowCapacity(tree.pageSize)
+	nchunks := (len(val) + capacity - 1) / capacity
+	for i := nchunks - 1; i >= 0; i-- {
+		chunk := val[i*capacity : min((i+1)*capacity, len(val))]
+		next = alloc(bnode.NewOverflowPage(tree.pageSize, next, chunk))
+	}
+	ref := make([]byte, overflowRefSize)
+	ref[0] = valOverflow
+	binary.LittleEndian.PutUint64(ref[1:], uint64(len(val)))
+	binary.LittleEndian.PutUint64(ref[9:], uint64(next))
+	return ref
+}
+
+// decodeVal returns the value stored in the leaf at ptr, reading the overflow pages if needed.
+// inline values are not copied.
+func (tree *BTree) decodeVal(ptr types.PagePtr, stored []byte) []byte {
+	if valTag(ptr, stored) == valInline {
+		return stored[1:]
+	}
+	size, first := decodeOverflowRef(ptr, stored)
+	val := make([]byte, 0, size)
+	tree.walkOverflow(size, first, func(_ types.PagePtr, page bnode.BNode) {
+		val = append(val, page.OverflowData()...)
+	})
+	return val
+}
+
+// freeVal deallocates the overflow pages of a value stored in the leaf at ptr, if any, see freePage
+func (tree *BTree) freeVal(ptr types.PagePtr, stored []byte) {
+	if valTag(ptr, stored) != valOverflow {
+		return
+	}
+	size, first := decodeOverflowRef(ptr, stored)
+	tree.walkOverflow(size, first, func(ptr types.PagePtr, _ bnode.BNode) {
+		tree.freePage(ptr)
+	})
+}
+
+// walkOverflow calls fn on the pages of the overflow chain of a value of size bytes, in order.
+// the walk stops as soon as the chain holds too many bytes or pages, a cycle for instance.
+func (tree *BTree) walkOverflow(size uint64, first types.PagePtr, fn func(ptr types.PagePtr, page bnode.BNode)) {
+	capacity := uint64(bnode.OverflowCapacity(tree.pageSize))
+	maxPages := (size + capacity - 1) / capacity
+	var bytes, pages uint64
+	for ptr := first; ptr != constant.NilPagePtr; {
+		page := tree.overflowPage(ptr)
+		bytes += uint64(len(page.OverflowData()))
+		pages++
+		if bytes > size || pages > maxPages {
+			corrupted(first, "overflow chain longer than its value of %d bytes", size)
+		}
+		fn(ptr, page)
+		ptr = page.OverflowNext()
+	}
+	if bytes != size {
+		corrupted(first, "overflow chain of %d bytes, expected %d", bytes, size)
+	}
+}
+
+// overflowPage reads the overflow page at ptr, see node
+func (tree *BTree) overflowPage(ptr types.PagePtr) bnode.BNode {
+	page := bnode.BNode(tree.pageManager.Get(ptr))
+	if page.Type() != bnode.BNODE_OVERFLOW {
+		corrupted(ptr, "page type %d, expected an overflow page", page.Type())
+	}
+	return page
+}
+
+// valTag returns the tag of a value stored in the leaf at ptr
+func valTag(ptr types.PagePtr, stored []byte) byte {
+	if len(stored) == 0 || (stored[0] != valInline && stored[0] != valOverflow) {
+		corrupted(ptr, "bad value tag")
+	}
+	return stored[0]
+}
+
+// decodeOverflowRef decodes the reference to an overflow chain stored in the leaf at ptr
+func decodeOverflowRef(ptr types.PagePtr, stored []byte) (uint64, types.PagePtr) {
+	if len(stored) != overflowRefSize {
+		corrupted(ptr, "overflow reference of %d bytes", len(stored))
+	}
+	size := binary.LittleEndian.Uint64(stored[1:])
+	if size > constant.BTREE_MAX_VAL_SIZE {
+		corrupted(ptr, "overflow value of %d bytes", size)
+	}
+	return size, types.PagePtr(binary.LittleEndian.Uint64(stored[9:]))
+}
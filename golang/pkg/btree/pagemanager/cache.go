@@ -0,0 +1,134 @@
+package pagemanager
+
+import (
+	"container/list"
+	"sync"
+	"trees/pkg/btree/bnode"
+	"trees/pkg/btree/types"
+)
+
+// Cache is a PageManager decorator, which keeps a copy of the hot internal nodes in memory.
+// the internal nodes are read by every lookup, while the leaves and the overflow pages
+// are too many to be worth caching, they are always read from the wrapped page manager.
+// the least recently used nodes are evicted to stay under the memory budget,
+// and a cached node is dropped when its page is freed or allocated again.
+//
+// a Cache can be used from several goroutines if the wrapped page manager can.
+type Cache struct {
+	inner PageManager
+	// shared by the views
+	lru *lru
+}
+
+var _ PageManager = (*Cache)(nil)
+
+// CacheStats are the counters of a cache
+type CacheStats struct {
+	// Hits is the number of reads served by the cache, Misses the number of reads of the wrapped page manager
+	Hits   uint64
+	Misses uint64
+	// Evictions is the number of nodes evicted to stay under the budget
+	Evictions uint64
+	// Bytes is the size of the cached nodes
+	Bytes int
+}
+
+type lru struct {
+	mu sync.Mutex
+	// the max size of the cached nodes in bytes
+	budget int
+	// the cached nodes, the most recently used first
+	order *list.List
+	nodes map[types.PagePtr]*list.Element
+	stats CacheStats
+}
+
+type cacheEntry struct {
+	ptr  types.PagePtr
+	node []byte
+}
+
+// NewCache wraps inner with a cache of budget bytes
+func NewCache(inner PageManager, budget int) *Cache {
+	return &Cache{
+		inner: inner,
+		lru:   &lru{budget: budget, order: list.New(), nodes: map[types.PagePtr]*list.Element{}},
+	}
+}
+
+// View returns a cache wrapping inner, which shares the cached nodes of c.
+// inner must read the same pages as the page manager of c, like the Reader of an OnDisk page manager.
+func (c *Cache) View(inner PageManager) *Cache {
+	return &Cache{inner: inner, lru: c.lru}
+}
+
+// Stats returns the counters of the cache, shared by its views
+func (c *Cache) Stats() CacheStats {
+	c.lru.mu.Lock()
+	defer c.lru.mu.Unlock()
+	return c.lru.stats
+}
+
+func (c *Cache) Get(ptr types.PagePtr) []byte {
+	if node, ok := c.lru.get(ptr); ok {
+		return node
+	}
+	page := c.inner.Get(ptr)
+	if bnode.BNode(page).Type() == bnode.BNODE_NODE {
+		c.lru.add(ptr, append([]byte(nil), page...))
+	}
+	return page
+}
+
+func (c *Cache) New(node []byte) types.PagePtr {
+	ptr := c.inner.New(node)
+	// the page may be a reused one, or one of a discarded update
+	c.lru.drop(ptr)
+	return ptr
+}
+
+func (c *Cache) Del(ptr types.PagePtr) {
+	c.lru.drop(ptr)
+	c.inner.Del(ptr)
+}
+
+func (l *lru) get(ptr types.PagePtr) ([]byte, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	elem, ok := l.nodes[ptr]
+	if !ok {
+		l.stats.Misses++
+		return nil, false
+	}
+	l.stats.Hits++
+	l.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).node, true
+}
+
+func (l *lru) add(ptr types.PagePtr, node []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.nodes[ptr]; ok || len(node) > l.budget {
+		return // added by a concurrent reader, or too big
+	}
+	for l.stats.Bytes+len(node) > l.budget {
+		l.remove(l.order.Back())
+		l.stats.Evictions++
+	}
+	l.nodes[ptr] = l.order.PushFront(&cacheEntry{ptr: ptr, node: node})
+	l.stats.Bytes += len(node)
+}
+
+func (l *lru) drop(ptr types.PagePtr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if elem, ok := l.nodes[ptr]; ok {
+		l.remove(elem)
+	}
+}
+
+func (l *lru) remove(elem *list.Element) {
+	entry := l.order.Remove(elem).(*cacheEntry)
+	delete(l.nodes, entry.ptr)
+	l.stats.Bytes -= len(entry.node)
+}
@@ -0,0 +1,72 @@
+package pagemanager
+
+import (
+	"testing"
+	"trees/pkg/btree/bnode"
+	"trees/pkg/btree/constant"
+	"trees/pkg/btree/storage"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newNode(btype uint16, key string) []byte {
+	node := bnode.BNode(make([]byte, constant.DEFAULT_PAGE_SIZE))
+	node.SetHeader(btype, 1)
+	node.CopyPtrAndKV(0, constant.NilPagePtr, []byte(key), nil)
+	return node
+}
+
+func TestCache(t *testing.T) {
+	inner := NewInMemory(constant.DEFAULT_PAGE_SIZE)
+	cache := NewCache(inner, 2*constant.DEFAULT_PAGE_SIZE)
+	a := cache.New(newNode(bnode.BNODE_NODE, "a"))
+	b := cache.New(newNode(bnode.BNODE_NODE, "b"))
+	c := cache.New(newNode(bnode.BNODE_NODE, "c"))
+	leaf := cache.New(newNode(bnode.BNODE_LEAF, "leaf"))
+
+	require.Equal(t, "a", string(bnode.BNode(cache.Get(a)).GetKey(0)))
+	require.Equal(t, "a", string(bnode.BNode(cache.Get(a)).GetKey(0)))
+	require.Equal(t, CacheStats{Hits: 1, Misses: 1, Bytes: constant.DEFAULT_PAGE_SIZE}, cache.Stats())
+
+	// the leaves are not cached
+	cache.Get(leaf)
+	cache.Get(leaf)
+	require.Equal(t, uint64(3), cache.Stats().Misses)
+
+	// the least recently used node is evicted
+	cache.Get(b)
+	cache.Get(a)
+	cache.Get(c)
+	stats := cache.Stats()
+	require.Equal(t, uint64(1), stats.Evictions)
+	require.Equal(t, 2*constant.DEFAULT_PAGE_SIZE, stats.Bytes)
+	cache.Get(a)
+	require.Equal(t, stats.Hits+1, cache.Stats().Hits)
+	cache.Get(b)
+	require.Equal(t, stats.Misses+1, cache.Stats().Misses)
+	require.Equal(t, uint64(2), cache.Stats().Evictions)
+
+	// a view shares the cached nodes
+	view := cache.View(inner)
+	require.Equal(t, "b", string(bnode.BNode(view.Get(b)).GetKey(0)))
+	require.Equal(t, stats.Hits+2, cache.Stats().Hits)
+
+	// the freed pages are dropped
+	cache.Del(a)
+	require.Equal(t, constant.DEFAULT_PAGE_SIZE, cache.Stats().Bytes)
+	cache.Del(b)
+	require.Zero(t, cache.Stats().Bytes)
+}
+
+func TestCacheReallocated(t *testing.T) {
+	pages, err := NewOnDisk(storage.NewMemFile(), constant.DEFAULT_PAGE_SIZE, 1)
+	require.NoError(t, err)
+	defer pages.Close()
+	cache := NewCache(pages, 10*constant.DEFAULT_PAGE_SIZE)
+	ptr := cache.New(newNode(bnode.BNODE_NODE, "discarded"))
+	require.Equal(t, "discarded", string(bnode.BNode(cache.Get(ptr)).GetKey(0)))
+	// the page of a discarded update is allocated again
+	pages.Rollback(1)
+	require.Equal(t, ptr, cache.New(newNode(bnode.BNODE_NODE, "new")))
+	require.Equal(t, "new", string(bnode.BNode(cache.Get(ptr)).GetKey(0)))
+}
@@ -1,47 +1,300 @@
 package pagemanager
 
 import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+	"trees/internal/errors"
 	"trees/pkg/btree/constant"
+	"trees/pkg/btree/storage"
 	"trees/pkg/btree/types"
 )
 
-// OnDisk pagemanager manages pages on disk, using mmap
-// TODO: figure out the proper interface/interaction between kvstore, btree, and ondisk page manager
+// OnDisk pagemanager manages the pages of a database file.
+// the flushed pages are read through read-only mappings of the file, and verified against their checksum.
+// the new pages are kept in memory until Flush writes them, and Commit makes them durable.
+// the 1st page of the file is left to the owner of the file, for its meta page.
+//
+// a single writer uses the page manager, while readers use the views returned by Reader.
 type OnDisk struct {
-	Path string // file name
-	// internals
-	fd   int
+	// Reuse returns a free page to hold a new node, if any, the new pages are appended otherwise.
+	// Free is called with the pages deleted by the tree, they are leaked if it's nil.
+	// they let the owner of the file manage the free pages.
+	Reuse func() (types.PagePtr, bool)
+	Free  func(types.PagePtr)
+
+	file     storage.File
+	pageSize int
+	// protects the mmap chunks list and the page count, which the readers use
+	mu sync.Mutex
+	// we use mmap to READ the file
+	// we use multiple mmap "chunks" (different mmap calls each) instead of
+	// a single one that we grow with mremap because mremap can potentially change
+	// the address of the memory region, which would invalidate the pointers
+	// and hinder concurrent readers
 	mmap struct {
 		total  int      // mmap size, can be larger than the file size
 		chunks [][]byte // multiple mmaps, can be non-continuous
 	}
+	// remember that the btree is implemented using copy-on-write, so any modification
+	// results in new nodes/pages being created: everytime btree calls 'new',
+	// to create a new node, it gets appended to temp and eventually flushed to disk
 	page struct {
-		flushed uint64   // database size in number of pages
-		temp    [][]byte // newly allocated pages
+		flushed uint64                   // database size in number of pages
+		temp    [][]byte                 // newly allocated pages
+		updates map[types.PagePtr][]byte // reused free pages, overwritten in place
 	}
 }
 
 var _ PageManager = (*OnDisk)(nil)
 
+// NewOnDisk maps file, which holds flushed pages of pageSize bytes.
+// the page manager owns the file from then on, it's closed by Close.
+func NewOnDisk(file storage.File, pageSize int, flushed uint64) (*OnDisk, error) {
+	errors.Assert(constant.ValidPageSize(pageSize), "valid page size")
+	errors.Assert(flushed >= 1, "the 1st page is the meta page")
+	od := &OnDisk{file: file, pageSize: pageSize}
+	od.page.flushed = flushed
+	od.page.updates = map[types.PagePtr][]byte{}
+	size, err := file.Size()
+	if err != nil {
+		return nil, err
+	}
+	if err := od.extendMmap(int(size)); err != nil {
+		return nil, err
+	}
+	return od, nil
+}
+
+// PageSize returns the size of the pages in bytes
+func (od *OnDisk) PageSize() int {
+	return od.pageSize
+}
+
+// Flushed returns the number of pages written to the file, including the meta page
+func (od *OnDisk) Flushed() uint64 {
+	return od.page.flushed
+}
+
+// Pending returns the number of new pages that are not written yet
+func (od *OnDisk) Pending() int {
+	return len(od.page.temp) + len(od.page.updates)
+}
+
 func (od *OnDisk) Get(ptr types.PagePtr) []byte {
-	start := types.PagePtr(0)
-	for _, chunk := range od.mmap.chunks {
-		end := start + types.PagePtr(len(chunk))/constant.BTREE_PAGE_SIZE
-		if ptr < end {
-			offset := constant.BTREE_PAGE_SIZE * (ptr - start)
-			return chunk[offset : offset+constant.BTREE_PAGE_SIZE]
+	// pages that were allocated but not yet flushed only live in memory
+	if node, ok := od.page.updates[ptr]; ok {
+		return node
+	}
+	if uint64(ptr) >= od.page.flushed {
+		idx := uint64(ptr) - od.page.flushed
+		if idx >= uint64(len(od.page.temp)) {
+			panic(&CorruptionError{Page: uint64(ptr), Reason: "not allocated"})
 		}
-		start = end
+		return od.page.temp[idx]
 	}
-	panic("bad ptr")
+	return mmapPage(od.mmap.chunks, od.pageSize, od.page.flushed, ptr)
 }
 
 func (od *OnDisk) New(node []byte) types.PagePtr {
+	if od.Reuse != nil {
+		if ptr, ok := od.Reuse(); ok {
+			od.page.updates[ptr] = node
+			return ptr
+		}
+	}
+	return od.Append(node)
+}
+
+// Append allocates a new page at the end of the file, without reusing a free page
+func (od *OnDisk) Append(node []byte) types.PagePtr {
 	ptr := od.page.flushed + uint64(len(od.page.temp)) // just append
 	od.page.temp = append(od.page.temp, node)
 	return types.PagePtr(ptr)
 }
 
 func (od *OnDisk) Del(ptr types.PagePtr) {
-	// do nothing
+	if od.Free != nil {
+		od.Free(ptr)
+	}
+}
+
+// Flush writes the new pages to the file, with their checksum.
+// they are not durable until the next Commit.
+func (od *OnDisk) Flush() error {
+	// extend the mmap if needed
+	size := (int(od.page.flushed) + len(od.page.temp)) * od.pageSize
+	if err := od.extendMmap(size); err != nil {
+		return err
+	}
+	// write data pages to the file
+	offset := int64(od.page.flushed) * int64(od.pageSize)
+	for _, tempPage := range od.page.temp {
+		setPageChecksum(tempPage)
+		n, err := od.file.WriteAt(tempPage, offset)
+		if err != nil {
+			return err
+		}
+		if n != len(tempPage) {
+			return io.ErrShortWrite
+		}
+		offset += int64(n)
+	}
+	// overwrite the reused pages
+	for ptr, page := range od.page.updates {
+		setPageChecksum(page)
+		n, err := od.file.WriteAt(page, int64(ptr)*int64(od.pageSize))
+		if err != nil {
+			return err
+		}
+		if n != len(page) {
+			return io.ErrShortWrite
+		}
+	}
+	// discard in-memory data
+	od.mu.Lock()
+	od.page.flushed += uint64(len(od.page.temp))
+	od.mu.Unlock()
+	od.page.temp = od.page.temp[:0]
+	clear(od.page.updates)
+	return nil
+}
+
+// Commit flushes the new pages, and then calls writeMeta to update the meta page of the file.
+// each step is made durable before the next one, so the meta page never references
+// pages that aren't on the disk.
+func (od *OnDisk) Commit(writeMeta func(file storage.File) error) error {
+	// 1. Write new nodes.
+	if err := od.Flush(); err != nil {
+		return err
+	}
+	// 2. `fsync` to enforce the order between 1 and 3.
+	if err := od.file.Sync(); err != nil {
+		return err
+	}
+	// 3. Update the root pointer atomically.
+	return od.WriteMeta(writeMeta)
+}
+
+// WriteMeta calls writeMeta to update the meta page of the file, and makes it durable.
+// unlike Commit, the new pages are left in memory.
+func (od *OnDisk) WriteMeta(writeMeta func(file storage.File) error) error {
+	if err := writeMeta(od.file); err != nil {
+		return err
+	}
+	// 4. `fsync` to make everything persistent.
+	return od.file.Sync()
+}
+
+// Rollback discards the new pages, and goes back to a file of flushed pages.
+// the pages written past it since are simply overwritten later.
+func (od *OnDisk) Rollback(flushed uint64) {
+	od.page.temp = od.page.temp[:0]
+	clear(od.page.updates)
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	od.page.flushed = flushed
+}
+
+// Reader returns a read-only page manager of the flushed pages, which can be used concurrently with the writer.
+// the owner of the file must not reuse the pages it reads.
+func (od *OnDisk) Reader() PageManager {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	// the flushed pages are all mapped by the current chunks,
+	// the writer only appends new chunks
+	return diskReader{chunks: od.mmap.chunks, pageSize: od.pageSize, flushed: od.page.flushed}
+}
+
+// Close unmaps and closes the file. the page manager and its readers can't be used afterwards.
+func (od *OnDisk) Close() error {
+	for _, chunk := range od.mmap.chunks {
+		if err := od.file.Unmap(chunk); err != nil {
+			return err
+		}
+	}
+	od.mmap.chunks, od.mmap.total = nil, 0
+	return od.file.Close()
+}
+
+// extendMmap extends the mmap region by creating a new chunk, if needed.
+// the new chunk is at least 64 MB, and otherwise a power of 2 of the current total size.
+func (od *OnDisk) extendMmap(size int) error {
+	if size <= od.mmap.total {
+		return nil // enough range
+	}
+	newMmapLen := max(od.mmap.total, 64<<20)
+	for od.mmap.total+newMmapLen < size {
+		newMmapLen *= 2 // still not enough?
+	}
+	chunk, err := od.file.Map(int64(od.mmap.total), newMmapLen)
+	if err != nil {
+		return err
+	}
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	od.mmap.total += newMmapLen
+	od.mmap.chunks = append(od.mmap.chunks, chunk)
+	return nil
+}
+
+// diskReader reads the flushed pages from the mmap chunks, it's read-only.
+type diskReader struct {
+	chunks   [][]byte
+	pageSize int
+	flushed  uint64
+}
+
+var _ PageManager = diskReader{}
+
+func (r diskReader) Get(ptr types.PagePtr) []byte {
+	return mmapPage(r.chunks, r.pageSize, r.flushed, ptr)
+}
+func (r diskReader) New([]byte) types.PagePtr {
+	panic("the readers are read-only")
+}
+func (r diskReader) Del(types.PagePtr) {
+	panic("the readers are read-only")
+}
+
+// read a flushed page from the mmap chunks, and verify it.
+// flushed is the number of pages of the file.
+func mmapPage(chunks [][]byte, pageSize int, flushed uint64, ptr types.PagePtr) []byte {
+	if ptr == constant.NilPagePtr || uint64(ptr) >= flushed {
+		panic(&CorruptionError{Page: uint64(ptr), Reason: fmt.Sprintf("out of the %d pages of the file", flushed)})
+	}
+	start := types.PagePtr(0)
+	for _, chunk := range chunks {
+		end := start + types.PagePtr(len(chunk)/pageSize)
+		if ptr < end {
+			offset := pageSize * int(ptr-start)
+			page := chunk[offset : offset+pageSize]
+			verifyPage(ptr, page)
+			return page
+		}
+		start = end
+	}
+	panic("bad ptr")
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// the last constant.PAGE_CHECKSUM_SIZE bytes of a page are the CRC32C of the rest of the page
+func pageChecksum(page []byte) uint32 {
+	return crc32.Checksum(page[:len(page)-constant.PAGE_CHECKSUM_SIZE], crcTable)
+}
+
+func setPageChecksum(page []byte) {
+	binary.LittleEndian.PutUint32(page[len(page)-constant.PAGE_CHECKSUM_SIZE:], pageChecksum(page))
+}
+
+// verifyPage panics with a *CorruptionError if the page doesn't match its checksum.
+// the pages are read deep inside the tree code, the panic is meant to be recovered by the owner of the file.
+func verifyPage(ptr types.PagePtr, page []byte) {
+	stored := binary.LittleEndian.Uint32(page[len(page)-constant.PAGE_CHECKSUM_SIZE:])
+	if sum := pageChecksum(page); sum != stored {
+		panic(&CorruptionError{Page: uint64(ptr), Reason: fmt.Sprintf("checksum %#08x, expected %#08x", sum, stored)})
+	}
 }
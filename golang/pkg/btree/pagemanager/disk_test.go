@@ -0,0 +1,44 @@
+package pagemanager
+
+import (
+	"io"
+	"testing"
+	"trees/pkg/btree/bnode"
+	"trees/pkg/btree/constant"
+	"trees/pkg/btree/storage"
+	"trees/pkg/btree/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// shortFile writes only the first half of the pages once short is set
+type shortFile struct {
+	*storage.MemFile
+	short bool
+}
+
+func (f *shortFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.short {
+		p = p[:len(p)/2]
+	}
+	return f.MemFile.WriteAt(p, off)
+}
+
+func TestFlushShortWrite(t *testing.T) {
+	file := &shortFile{MemFile: storage.NewMemFile()}
+	pages, err := NewOnDisk(file, constant.DEFAULT_PAGE_SIZE, 1)
+	require.NoError(t, err)
+	defer pages.Close()
+
+	file.short = true
+	pages.New(newNode(bnode.BNODE_LEAF, "appended"))
+	require.ErrorIs(t, pages.Flush(), io.ErrShortWrite)
+
+	file.short = false
+	require.NoError(t, pages.Flush())
+	// the reused pages are overwritten in place
+	pages.Reuse = func() (types.PagePtr, bool) { return 1, true }
+	pages.New(newNode(bnode.BNODE_LEAF, "reused"))
+	file.short = true
+	require.ErrorIs(t, pages.Flush(), io.ErrShortWrite)
+}
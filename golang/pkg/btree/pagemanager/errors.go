@@ -0,0 +1,38 @@
+package pagemanager
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrCorruptPage is matched by errors.Is for every *CorruptionError
+var ErrCorruptPage = errors.New("corrupted page")
+
+// CorruptionError reports a page that can't be trusted: its content doesn't match its checksum,
+// it's out of the file, or it's not the kind of page its pointer leads to.
+// the pages are read deep inside the tree code, which panics with a *CorruptionError,
+// recovered by the tree methods and cursors returning an error, or by the owner of the tree.
+type CorruptionError struct {
+	Page   uint64
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupted page %d: %s", e.Page, e.Reason)
+}
+
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorruptPage
+}
+
+// RecoverCorruption turns a *CorruptionError panic into the returned error, and lets the other panics go on.
+// it must be deferred directly by the functions reading pages, for recover to stop the panic.
+func RecoverCorruption(err *error) {
+	if r := recover(); r != nil {
+		cerr, ok := r.(*CorruptionError)
+		if !ok {
+			panic(r)
+		}
+		*err = cerr
+	}
+}
@@ -10,27 +10,31 @@ import (
 
 // memory.Inmemory is meant to be used for testing the BTree implementations
 type InMemory struct {
-	ref   map[string]string             // the reference data
-	pages map[types.PagePtr]bnode.BNode // in-memory pages
+	ref      map[string]string             // the reference data
+	pages    map[types.PagePtr]bnode.BNode // in-memory pages
+	pageSize int                           // max node size in bytes
 }
 
 var _ PageManager = (*InMemory)(nil)
 
-func NewInMemory() *InMemory {
+func NewInMemory(pageSize int) *InMemory {
 	return &InMemory{
-		ref:   map[string]string{},
-		pages: map[types.PagePtr]bnode.BNode{},
+		ref:      map[string]string{},
+		pages:    map[types.PagePtr]bnode.BNode{},
+		pageSize: pageSize,
 	}
 }
 
 func (pm *InMemory) Get(ptr types.PagePtr) []byte {
 	node, ok := pm.pages[ptr]
-	errors.Assert(ok, "page not found")
+	if !ok {
+		panic(&CorruptionError{Page: uint64(ptr), Reason: "page not found"})
+	}
 	return node
 }
 
 func (pm *InMemory) New(node []byte) types.PagePtr {
-	errors.Assert(bnode.BNode(node).NumBytes() <= constant.BTREE_PAGE_SIZE, "node size exceeds page size")
+	errors.Assert(bnode.BNode(node).NumBytes() <= uint32(constant.NodeCapacity(pm.pageSize)), "node size exceeds page size")
 	ptr := types.PagePtr(uintptr(unsafe.Pointer(&node[0])))
 	errors.Assert(pm.pages[ptr] == nil, "page already exists")
 	pm.pages[ptr] = node
@@ -41,3 +45,8 @@ func (pm *InMemory) Del(ptr types.PagePtr) {
 	errors.Assert(pm.pages[ptr] != nil, "page not found")
 	delete(pm.pages, ptr)
 }
+
+// NumPages returns the number of allocated pages
+func (pm *InMemory) NumPages() int {
+	return len(pm.pages)
+}
@@ -0,0 +1,48 @@
+package pagemanager
+
+import (
+	"io"
+	"trees/internal/errors"
+	"trees/pkg/btree/types"
+)
+
+// Stream is a write-only page manager, which writes the new pages to a writer as they are allocated,
+// with their checksum. the pages are numbered consecutively, they can't be read back nor freed.
+type Stream struct {
+	w        io.Writer
+	pageSize int
+	next     types.PagePtr
+	// the first write error, the pages are dropped afterwards
+	err error
+}
+
+var _ PageManager = (*Stream)(nil)
+
+// NewStream returns a page manager writing the pages of pageSize bytes to w, the first one being page first
+func NewStream(w io.Writer, pageSize int, first types.PagePtr) *Stream {
+	return &Stream{w: w, pageSize: pageSize, next: first}
+}
+
+// Err returns the first error writing the pages, if any
+func (s *Stream) Err() error {
+	return s.err
+}
+
+func (s *Stream) Get(types.PagePtr) []byte {
+	panic("the stream pages can't be read")
+}
+
+func (s *Stream) New(node []byte) types.PagePtr {
+	errors.Assert(len(node) == s.pageSize, "the node is a whole page")
+	ptr := s.next
+	s.next++
+	if s.err == nil {
+		setPageChecksum(node)
+		_, s.err = s.w.Write(node)
+	}
+	return ptr
+}
+
+func (s *Stream) Del(types.PagePtr) {
+	panic("the stream pages can't be freed")
+}
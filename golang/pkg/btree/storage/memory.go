@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+)
+
+// ErrCrashed is returned by the operations of a MemFile after its simulated power failure
+var ErrCrashed = errors.New("storage: crashed")
+
+// MemFile is an in-memory File for tests, which simulates the failures of a disk:
+// a crash can lose or tear the writes that were not synced, and Sync can fail.
+type MemFile struct {
+	mu sync.Mutex
+	// the content seen by the mappings
+	data []byte
+	// the content that survives a crash
+	synced []byte
+	// the writes since the last successful sync, in order
+	pending  []memWrite
+	mappings []memMapping
+	// the error returned by a later Sync, after syncFailAfter successful ones
+	syncErr       error
+	syncFailAfter int
+	// shared by the files of the same disk
+	crash *memCrash
+}
+
+// the simulated power failure of a disk
+type memCrash struct {
+	mu sync.Mutex
+	// number of writes and syncs before the crash, negative to never crash
+	after   int
+	crashed bool
+}
+
+type memWrite struct {
+	off  int64
+	data []byte
+}
+
+type memMapping struct {
+	off     int64
+	mapping []byte
+}
+
+var _ File = (*MemFile)(nil)
+
+// NewMemFile returns an empty file
+func NewMemFile() *MemFile {
+	return &MemFile{crash: &memCrash{after: -1}}
+}
+
+// Sibling returns an empty file on the same disk as f: they crash together,
+// and the writes and syncs of both count toward the crash.
+func (f *MemFile) Sibling() *MemFile {
+	return &MemFile{crash: f.crash}
+}
+
+// FailSync makes the Sync following n more successful ones return err, without making the writes durable.
+// the writes stay pending, a later crash may still persist them.
+func (f *MemFile) FailSync(n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.syncErr, f.syncFailAfter = err, n
+}
+
+// CrashAfter simulates a power failure after n more writes or syncs:
+// the operations that follow fail with ErrCrashed, on f and on its siblings.
+func (f *MemFile) CrashAfter(n int) {
+	f.crash.mu.Lock()
+	defer f.crash.mu.Unlock()
+	f.crash.after = n
+}
+
+// Crashed reports whether the simulated power failure happened
+func (f *MemFile) Crashed() bool {
+	f.crash.mu.Lock()
+	defer f.crash.mu.Unlock()
+	return f.crash.crashed
+}
+
+// Recover returns the file found after a reboot: the synced content,
+// plus a random subset of the unsynced writes, some of them torn.
+func (f *MemFile) Recover(rng *rand.Rand) *MemFile {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data := append([]byte(nil), f.synced...)
+	for _, w := range f.pending {
+		switch rng.Intn(3) {
+		case 0: // lost
+			continue
+		case 1: // torn, only a prefix made it to the disk
+			data = writeAt(data, w.data[:rng.Intn(len(w.data)+1)], w.off)
+		default:
+			data = writeAt(data, w.data, w.off)
+		}
+	}
+	return &MemFile{data: data, synced: append([]byte(nil), data...), crash: &memCrash{after: -1}}
+}
+
+// count an operation toward the crash
+func (f *MemFile) step() error {
+	c := f.crash
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.crashed {
+		return ErrCrashed
+	}
+	if c.after == 0 {
+		c.crashed = true
+		return ErrCrashed
+	}
+	if c.after > 0 {
+		c.after--
+	}
+	return nil
+}
+
+func writeAt(data []byte, p []byte, off int64) []byte {
+	if end := int(off) + len(p); end > len(data) {
+		data = append(data, make([]byte, end-len(data))...)
+	}
+	copy(data[off:], p)
+	return data
+}
+
+func (f *MemFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.step(); err != nil {
+		return 0, err
+	}
+	f.data = writeAt(f.data, p, off)
+	f.pending = append(f.pending, memWrite{off: off, data: append([]byte(nil), p...)})
+	for _, m := range f.mappings {
+		// copy the overlapping part into the mapping
+		start, end := max(off, m.off), min(off+int64(len(p)), m.off+int64(len(m.mapping)))
+		if start < end {
+			copy(m.mapping[start-m.off:end-m.off], p[start-off:end-off])
+		}
+	}
+	return len(p), nil
+}
+
+func (f *MemFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.step(); err != nil {
+		return err
+	}
+	if err := f.syncErr; err != nil {
+		if f.syncFailAfter == 0 {
+			f.syncErr = nil
+			return err
+		}
+		f.syncFailAfter--
+	}
+	f.synced = append(f.synced[:0], f.data...)
+	f.pending = f.pending[:0]
+	return nil
+}
+
+func (f *MemFile) Size() (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return int64(len(f.data)), nil
+}
+
+func (f *MemFile) Map(offset int64, length int) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	mapping := make([]byte, length)
+	if offset < int64(len(f.data)) {
+		copy(mapping, f.data[offset:])
+	}
+	f.mappings = append(f.mappings, memMapping{off: offset, mapping: mapping})
+	return mapping, nil
+}
+
+func (f *MemFile) Unmap(mapping []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, m := range f.mappings {
+		if &m.mapping[0] == &mapping[0] {
+			f.mappings = append(f.mappings[:i], f.mappings[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("storage: unknown mapping")
+}
+
+func (f *MemFile) Close() error {
+	return nil
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+)
+
+// OSFile is a File of the OS file system, mapped with mmap
+type OSFile struct {
+	fd int
+}
+
+var _ File = (*OSFile)(nil)
+
+// OpenOSFile opens the file at path, creating it if it doesn't exist
+func OpenOSFile(file string) (*OSFile, error) {
+	// open or create the file
+	flags := os.O_RDWR | os.O_CREATE
+	fd, err := syscall.Open(file, flags, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+	// fsync the directory
+	if err = SyncDir(path.Dir(file)); err != nil {
+		_ = syscall.Close(fd) // may leave an empty file
+		return nil, err
+	}
+	return &OSFile{fd: fd}, nil
+}
+
+// SyncDir makes the entries of the directory durable: the files created, renamed or removed in it
+func SyncDir(dir string) error {
+	dirfd, err := syscall.Open(dir, os.O_RDONLY|syscall.O_DIRECTORY, 0o644)
+	if err != nil {
+		return fmt.Errorf("open directory: %w", err)
+	}
+	defer syscall.Close(dirfd)
+	if err := syscall.Fsync(dirfd); err != nil {
+		return fmt.Errorf("fsync directory: %w", err)
+	}
+	return nil
+}
+
+func (f *OSFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := syscall.Pwrite(f.fd, p, off)
+	if err != nil {
+		return n, fmt.Errorf("write: %w", err)
+	}
+	if n != len(p) {
+		return n, fmt.Errorf("incomplete write: wrote %d bytes instead of %d", n, len(p))
+	}
+	return n, nil
+}
+
+func (f *OSFile) Sync() error {
+	if err := syscall.Fsync(f.fd); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
+}
+
+func (f *OSFile) Size() (int64, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(f.fd, &stat); err != nil {
+		return 0, fmt.Errorf("stat: %w", err)
+	}
+	return stat.Size, nil
+}
+
+func (f *OSFile) Map(offset int64, length int) ([]byte, error) {
+	mapping, err := syscall.Mmap(f.fd, offset, length, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("mmap: %w", err)
+	}
+	return mapping, nil
+}
+
+func (f *OSFile) Unmap(mapping []byte) error {
+	if err := syscall.Munmap(mapping); err != nil {
+		return fmt.Errorf("munmap: %w", err)
+	}
+	return nil
+}
+
+func (f *OSFile) Close() error {
+	return syscall.Close(f.fd)
+}
@@ -0,0 +1,19 @@
+package storage
+
+// File is the storage of a database file.
+// the kvstore reads the file through read-only mappings, and updates it with WriteAt.
+type File interface {
+	// WriteAt writes p at offset off, extending the file if needed
+	WriteAt(p []byte, off int64) (int, error)
+	// Sync makes the previous writes durable
+	Sync() error
+	// Size returns the size of the file in bytes
+	Size() (int64, error)
+	// Map returns a read-only mapping of length bytes of the file starting at offset,
+	// it can extend past the end of the file, and reflects the later writes.
+	Map(offset int64, length int) ([]byte, error)
+	// Unmap releases a mapping returned by Map
+	Unmap(mapping []byte) error
+	// Close releases the file, the mappings must be released first
+	Close() error
+}
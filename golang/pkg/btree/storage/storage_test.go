@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"errors"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testFile(t *testing.T, f File) {
+	_, err := f.WriteAt([]byte("hello"), 2)
+	require.NoError(t, err)
+	size, err := f.Size()
+	require.NoError(t, err)
+	require.Equal(t, int64(7), size)
+	// the mappings can extend past the end of the file, and see the later writes
+	mapping, err := f.Map(0, 4096)
+	require.NoError(t, err)
+	require.Equal(t, "\x00\x00hello", string(mapping[:7]))
+	_, err = f.WriteAt([]byte("world"), 100)
+	require.NoError(t, err)
+	require.NoError(t, f.Sync())
+	require.Equal(t, "world", string(mapping[100:105]))
+	require.NoError(t, f.Unmap(mapping))
+	require.NoError(t, f.Close())
+}
+
+func TestOSFile(t *testing.T) {
+	f, err := OpenOSFile(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	testFile(t, f)
+}
+
+func TestMemFile(t *testing.T) {
+	testFile(t, NewMemFile())
+
+	t.Run("failed sync", func(t *testing.T) {
+		f := NewMemFile()
+		injected := errors.New("injected")
+		f.FailSync(1, injected)
+		_, err := f.WriteAt([]byte("a"), 0)
+		require.NoError(t, err)
+		require.NoError(t, f.Sync())
+		_, err = f.WriteAt([]byte("b"), 1)
+		require.NoError(t, err)
+		require.ErrorIs(t, f.Sync(), injected)
+		// the unsynced write can be lost
+		for seed := int64(0); seed < 10; seed++ {
+			data := f.Recover(rand.New(rand.NewSource(seed))).data
+			require.Contains(t, []string{"a", "ab"}, string(data))
+		}
+	})
+
+	t.Run("crash", func(t *testing.T) {
+		f := NewMemFile()
+		f.CrashAfter(2)
+		_, err := f.WriteAt([]byte("abc"), 0)
+		require.NoError(t, err)
+		require.NoError(t, f.Sync())
+		require.False(t, f.Crashed())
+		_, err = f.WriteAt([]byte("def"), 3)
+		require.ErrorIs(t, err, ErrCrashed)
+		require.True(t, f.Crashed())
+		require.ErrorIs(t, f.Sync(), ErrCrashed)
+		require.Equal(t, "abc", string(f.Recover(rand.New(rand.NewSource(0))).data))
+	})
+
+	t.Run("siblings", func(t *testing.T) {
+		f := NewMemFile()
+		g := f.Sibling()
+		f.CrashAfter(2)
+		_, err := f.WriteAt([]byte("abc"), 0)
+		require.NoError(t, err)
+		_, err = g.WriteAt([]byte("def"), 0)
+		require.NoError(t, err)
+		// the 3rd operation of the disk
+		require.ErrorIs(t, f.Sync(), ErrCrashed)
+		require.True(t, g.Crashed())
+		require.ErrorIs(t, g.Sync(), ErrCrashed)
+	})
+}
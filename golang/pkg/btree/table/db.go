@@ -0,0 +1,298 @@
+package table
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"trees/pkg/btree/kvstore"
+)
+
+// CATALOG
+// the tables live in the tree of a KV, each one under its own key prefix.
+// the prefixes below TABLE_PREFIX_MIN are reserved for the internal tables:
+//   - @meta holds the next prefix to assign.
+//   - @table holds the definitions of the tables, as JSON, by name.
+//
+// the internal tables are regular tables, their records are encoded like the others.
+const TABLE_PREFIX_MIN = 100
+
+var tableMeta = &TableDef{
+	Name:   "@meta",
+	Types:  []Type{TypeString, TypeBytes},
+	Cols:   []string{"key", "val"},
+	PKeys:  1,
+	Prefix: 1,
+}
+
+var tableCatalog = &TableDef{
+	Name:   "@table",
+	Types:  []Type{TypeString, TypeBytes},
+	Cols:   []string{"name", "def"},
+	PKeys:  1,
+	Prefix: 2,
+}
+
+// DB is a relational layer on top of a KV: tables of typed records, indexed by their primary key.
+// it can be used from several goroutines, like the KV.
+type DB struct {
+	kv *kvstore.KV
+	mu sync.Mutex
+	// the definitions read from the catalog, which never change once created
+	tables map[string]*TableDef
+}
+
+// New returns a DB storing its tables in kv.
+// the KV must only be updated through the DB.
+func New(kv *kvstore.KV) *DB {
+	return &DB{kv: kv, tables: map[string]*TableDef{}}
+}
+
+// getter reads a key from a transaction or a snapshot
+type getter func(key []byte) ([]byte, bool, error)
+
+// get reads the record of pkey from a table, and returns all its columns in the order of the table
+func get(read getter, def *TableDef, pkey []Value) ([]Value, bool, error) {
+	val, ok, err := read(encodeKey(def.Prefix, pkey))
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	vals := make([]Value, len(def.Cols))
+	copy(vals, pkey)
+	for i := def.PKeys; i < len(def.Cols); i++ {
+		vals[i].Type = def.Types[i]
+	}
+	if err := decodeValues(val, vals[def.PKeys:]); err != nil {
+		return nil, false, fmt.Errorf("table %q: %w", def.Name, err)
+	}
+	return vals, true, nil
+}
+
+// tableDef returns the definition of a table, or nil if it doesn't exist
+func (db *DB) tableDef(read getter, name string) (*TableDef, error) {
+	db.mu.Lock()
+	def := db.tables[name]
+	db.mu.Unlock()
+	if def != nil {
+		return def, nil
+	}
+	vals, ok, err := get(read, tableCatalog, []Value{String(name)})
+	if err != nil || !ok {
+		return nil, err
+	}
+	def = &TableDef{}
+	if err := json.Unmarshal(vals[1].Str, def); err != nil {
+		return nil, fmt.Errorf("table %q: bad definition: %w", name, err)
+	}
+	db.mu.Lock()
+	db.tables[name] = def
+	db.mu.Unlock()
+	return def, nil
+}
+
+// table returns the definition of a table, and fails if it doesn't exist
+func (db *DB) table(read getter, name string) (*TableDef, error) {
+	def, err := db.tableDef(read, name)
+	if err == nil && def == nil {
+		err = fmt.Errorf("table %q doesn't exist", name)
+	}
+	return def, err
+}
+
+// CreateTable creates a table from its definition, and assigns its prefix.
+func (db *DB) CreateTable(def TableDef) error {
+	if err := def.check(); err != nil {
+		return err
+	}
+	tx := db.kv.Begin()
+	if err := createTable(db, tx, def); err != nil {
+		tx.Abort()
+		return err
+	}
+	return tx.Commit()
+}
+
+func createTable(db *DB, tx *kvstore.KVTX, def TableDef) error {
+	existing, err := db.tableDef(tx.Get, def.Name)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("table %q already exists", def.Name)
+	}
+	def.Prefix = TABLE_PREFIX_MIN
+	meta, ok, err := get(tx.Get, tableMeta, []Value{String("next_prefix")})
+	if err != nil {
+		return err
+	}
+	if ok {
+		if len(meta[1].Str) != 4 {
+			return fmt.Errorf("corrupted catalog: bad next prefix")
+		}
+		def.Prefix = binary.LittleEndian.Uint32(meta[1].Str)
+	}
+	data, err := json.Marshal(def)
+	if err != nil {
+		return err
+	}
+	next := binary.LittleEndian.AppendUint32(nil, def.Prefix+1)
+	if _, err := set(tx, tableMeta, []Value{String("next_prefix"), Bytes(next)}, modeUpsert); err != nil {
+		return err
+	}
+	_, err = set(tx, tableCatalog, []Value{String(def.Name), Bytes(data)}, modeUpsert)
+	return err
+}
+
+// Get reads a record by its primary key: rec holds the primary key columns,
+// and receives all the columns of the table when it's found.
+func (db *DB) Get(table string, rec *Record) (bool, error) {
+	snap := db.kv.Snapshot()
+	defer snap.Release()
+	return txGet(db, snap.Get, table, rec)
+}
+
+// Insert adds a record, and reports whether it was added: it's not if its primary key exists.
+func (db *DB) Insert(table string, rec Record) (bool, error) {
+	return db.update(table, rec, modeInsert)
+}
+
+// Update replaces a record, and reports whether it was replaced: it's not if its primary key doesn't exist.
+func (db *DB) Update(table string, rec Record) (bool, error) {
+	return db.update(table, rec, modeUpdate)
+}
+
+// Upsert adds or replaces a record, and reports whether it was added.
+func (db *DB) Upsert(table string, rec Record) (bool, error) {
+	return db.update(table, rec, modeUpsert)
+}
+
+// Delete deletes a record by its primary key, and reports whether it existed.
+func (db *DB) Delete(table string, rec Record) (bool, error) {
+	tx := db.Begin()
+	deleted, err := tx.Delete(table, rec)
+	if err != nil {
+		tx.Abort()
+		return false, err
+	}
+	return deleted, tx.Commit()
+}
+
+// update writes a record in its own transaction
+func (db *DB) update(table string, rec Record, mode int) (bool, error) {
+	tx := db.Begin()
+	updated, err := tx.update(table, rec, mode)
+	if err != nil {
+		tx.Abort()
+		return false, err
+	}
+	return updated, tx.Commit()
+}
+
+// Tx is a read-write transaction over the tables, see kvstore.KVTX.
+type Tx struct {
+	db *DB
+	kv *kvstore.KVTX
+}
+
+// Begin starts a read-write transaction, it must be ended by Commit or Abort.
+func (db *DB) Begin() *Tx {
+	return &Tx{db: db, kv: db.kv.Begin()}
+}
+
+// Commit makes the updates of the transaction durable and visible.
+func (tx *Tx) Commit() error {
+	return tx.kv.Commit()
+}
+
+// Abort discards the updates of the transaction.
+func (tx *Tx) Abort() {
+	tx.kv.Abort()
+}
+
+// Get reads a record by its primary key, including the updates of the transaction, see DB.Get.
+func (tx *Tx) Get(table string, rec *Record) (bool, error) {
+	return txGet(tx.db, tx.kv.Get, table, rec)
+}
+
+// Insert adds a record if its primary key doesn't exist, see DB.Insert.
+func (tx *Tx) Insert(table string, rec Record) (bool, error) {
+	return tx.update(table, rec, modeInsert)
+}
+
+// Update replaces a record if its primary key exists, see DB.Update.
+func (tx *Tx) Update(table string, rec Record) (bool, error) {
+	return tx.update(table, rec, modeUpdate)
+}
+
+// Upsert adds or replaces a record, see DB.Upsert.
+func (tx *Tx) Upsert(table string, rec Record) (bool, error) {
+	return tx.update(table, rec, modeUpsert)
+}
+
+// Delete deletes a record by its primary key, see DB.Delete.
+// like with kvstore.KVTX, the transaction must be aborted if it returns an error.
+func (tx *Tx) Delete(table string, rec Record) (bool, error) {
+	def, err := tx.db.table(tx.kv.Get, table)
+	if err != nil {
+		return false, err
+	}
+	pkey, err := def.primaryKey(rec)
+	if err != nil {
+		return false, err
+	}
+	return tx.kv.Del(encodeKey(def.Prefix, pkey))
+}
+
+func (tx *Tx) update(table string, rec Record, mode int) (bool, error) {
+	def, err := tx.db.table(tx.kv.Get, table)
+	if err != nil {
+		return false, err
+	}
+	vals, err := def.row(rec)
+	if err != nil {
+		return false, err
+	}
+	return set(tx.kv, def, vals, mode)
+}
+
+func txGet(db *DB, read getter, table string, rec *Record) (bool, error) {
+	def, err := db.table(read, table)
+	if err != nil {
+		return false, err
+	}
+	pkey, err := def.primaryKey(*rec)
+	if err != nil {
+		return false, err
+	}
+	vals, ok, err := get(read, def, pkey)
+	if err != nil || !ok {
+		return false, err
+	}
+	rec.Cols = append([]string(nil), def.Cols...)
+	rec.Vals = vals
+	return true, nil
+}
+
+// the update modes
+const (
+	modeUpsert = 0 // insert or replace
+	modeInsert = 1 // insert only
+	modeUpdate = 2 // replace only
+)
+
+// set writes the record vals, in the order of the table, according to mode.
+// it reports whether the record was written by an insert or update, and added by an upsert.
+func set(tx *kvstore.KVTX, def *TableDef, vals []Value, mode int) (bool, error) {
+	key := encodeKey(def.Prefix, vals[:def.PKeys])
+	_, exists, err := tx.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if (mode == modeInsert && exists) || (mode == modeUpdate && !exists) {
+		return false, nil
+	}
+	if err := tx.Set(key, encodeValues(vals[def.PKeys:])); err != nil {
+		return false, err
+	}
+	return !exists || mode == modeUpdate, nil
+}
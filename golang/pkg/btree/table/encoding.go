@@ -0,0 +1,76 @@
+package table
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"trees/pkg/btree/codec"
+)
+
+// KEY ENCODING
+// the key of a record is the prefix of its table followed by its primary key, as a tuple:
+// | prefix | pkey tuple |
+// |   4B   |            |
+// the prefix is big endian, so that the records of a table are contiguous, and the tuple
+// is encoded by the codec package, so that the keys sort like the primary keys.
+//
+// the value of a record holds the other columns, in the order of the table, without any padding:
+// an int64 is a zigzag varint, bytes and strings are a uvarint length followed by the data.
+
+// encodeKey returns the key of a record from the values of its primary key
+func encodeKey(prefix uint32, pkey []Value) []byte {
+	key := binary.BigEndian.AppendUint32(nil, prefix)
+	for _, val := range pkey {
+		switch val.Type {
+		case TypeInt64:
+			key = codec.AppendInt64(key, val.I64)
+		case TypeBytes:
+			key = codec.AppendBytes(key, val.Str)
+		case TypeString:
+			key = codec.AppendString(key, string(val.Str))
+		}
+	}
+	return key
+}
+
+// encodeValues returns the value of a record from the values of its other columns
+func encodeValues(vals []Value) []byte {
+	var out []byte
+	for _, val := range vals {
+		switch val.Type {
+		case TypeInt64:
+			out = binary.AppendVarint(out, val.I64)
+		case TypeBytes, TypeString:
+			out = binary.AppendUvarint(out, uint64(len(val.Str)))
+			out = append(out, val.Str...)
+		}
+	}
+	return out
+}
+
+// decodeValues decodes the value of a record into vals, whose types are set.
+// the decoded bytes are copied, data may be a page of the tree.
+func decodeValues(data []byte, vals []Value) error {
+	for i := range vals {
+		switch vals[i].Type {
+		case TypeInt64:
+			v, n := binary.Varint(data)
+			if n <= 0 {
+				return fmt.Errorf("corrupted record value")
+			}
+			vals[i].I64 = v
+			data = data[n:]
+		case TypeBytes, TypeString:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return fmt.Errorf("corrupted record value")
+			}
+			vals[i].Str = bytes.Clone(data[n : n+int(size)])
+			data = data[n+int(size):]
+		}
+	}
+	if len(data) != 0 {
+		return fmt.Errorf("corrupted record value")
+	}
+	return nil
+}
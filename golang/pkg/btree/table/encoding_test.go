@@ -0,0 +1,80 @@
+package table
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// compareValues compares two tuples of values of the same types
+func compareValues(a, b []Value) int {
+	for i := range a {
+		var c int
+		if a[i].Type == TypeInt64 {
+			switch {
+			case a[i].I64 < b[i].I64:
+				c = -1
+			case a[i].I64 > b[i].I64:
+				c = 1
+			}
+		} else {
+			c = bytes.Compare(a[i].Str, b[i].Str)
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func TestKeyOrder(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	ints := []int64{math.MinInt64, -1 << 40, -256, -1, 0, 1, 255, 256, 1 << 40, math.MaxInt64}
+	strs := []string{"", "\x00", "\x00\x00", "\x00\x01", "\x01", "\x01\x00", "\x02", "a", "a\x00", "a\x00b", "a\x01", "ab", "b", "\xff"}
+	var tuples [][]Value
+	for i := 0; i < 1000; i++ {
+		tuples = append(tuples, []Value{
+			String(strs[rng.Intn(len(strs))]),
+			Int64(ints[rng.Intn(len(ints))]),
+			Bytes([]byte(strs[rng.Intn(len(strs))])),
+		})
+	}
+	keys := map[string][]Value{}
+	for _, tuple := range tuples {
+		keys[string(encodeKey(TABLE_PREFIX_MIN, tuple))] = tuple
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	for i := 1; i < len(sorted); i++ {
+		require.Equal(t, -1, compareValues(keys[sorted[i-1]], keys[sorted[i]]), "%q < %q", sorted[i-1], sorted[i])
+	}
+
+	// the tables are contiguous
+	require.Less(t, string(encodeKey(1, []Value{String("\xff\xff")})), string(encodeKey(2, []Value{String("")})))
+}
+
+func TestValues(t *testing.T) {
+	vals := []Value{Int64(math.MinInt64), String("héllo"), Int64(-1), Bytes(nil), Bytes([]byte{0, 1, 2}), Int64(300)}
+	data := encodeValues(vals)
+	require.Len(t, data, 10+7+1+1+4+2, "compact")
+	decoded := make([]Value, len(vals))
+	for i := range vals {
+		decoded[i].Type = vals[i].Type
+	}
+	require.NoError(t, decodeValues(data, decoded))
+	for i := range vals {
+		require.Equal(t, vals[i].I64, decoded[i].I64)
+		require.Equal(t, string(vals[i].Str), string(decoded[i].Str))
+	}
+
+	require.Error(t, decodeValues(data[:len(data)-1], decoded), "truncated")
+	require.Error(t, decodeValues(append(data, 0), decoded), "trailing bytes")
+	require.Error(t, decodeValues([]byte{0x7f, 'a'}, []Value{{Type: TypeBytes}}), "bad length")
+}
@@ -0,0 +1,183 @@
+package table
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// Type is the type of a column
+type Type uint32
+
+const (
+	TypeInt64  Type = 1
+	TypeBytes  Type = 2
+	TypeString Type = 3
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeInt64:
+		return "int64"
+	case TypeBytes:
+		return "bytes"
+	case TypeString:
+		return "string"
+	default:
+		return fmt.Sprintf("Type(%d)", uint32(t))
+	}
+}
+
+// Value is a typed value, the int64 values are in I64 and the others in Str
+type Value struct {
+	Type Type
+	I64  int64
+	Str  []byte
+}
+
+// Int64 returns an int64 value
+func Int64(v int64) Value {
+	return Value{Type: TypeInt64, I64: v}
+}
+
+// Bytes returns a bytes value
+func Bytes(v []byte) Value {
+	return Value{Type: TypeBytes, Str: v}
+}
+
+// String returns a string value
+func String(v string) Value {
+	return Value{Type: TypeString, Str: []byte(v)}
+}
+
+// Record is a row of a table, as a list of named columns.
+// the columns may be in any order.
+type Record struct {
+	Cols []string
+	Vals []Value
+}
+
+func (rec *Record) Add(col string, val Value) *Record {
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, val)
+	return rec
+}
+
+func (rec *Record) AddInt64(col string, val int64) *Record {
+	return rec.Add(col, Int64(val))
+}
+
+func (rec *Record) AddBytes(col string, val []byte) *Record {
+	return rec.Add(col, Bytes(val))
+}
+
+func (rec *Record) AddString(col string, val string) *Record {
+	return rec.Add(col, String(val))
+}
+
+// Get returns the value of a column, or nil if the record doesn't have it
+func (rec *Record) Get(col string) *Value {
+	for i, c := range rec.Cols {
+		if c == col {
+			return &rec.Vals[i]
+		}
+	}
+	return nil
+}
+
+// TableDef is the schema of a table.
+// the first PKeys columns are the primary key, which identifies a record.
+type TableDef struct {
+	Name  string
+	Types []Type
+	Cols  []string
+	PKeys int
+	// the prefix of the keys of the table records, assigned by CreateTable
+	Prefix uint32
+}
+
+// check verifies a table definition before it's created
+func (def *TableDef) check() error {
+	switch {
+	case def.Name == "":
+		return fmt.Errorf("the table name is empty")
+	case def.Name[0] == '@':
+		return fmt.Errorf("table %q: the names starting with @ are reserved", def.Name)
+	case len(def.Cols) == 0:
+		return fmt.Errorf("table %q: no columns", def.Name)
+	case len(def.Types) != len(def.Cols):
+		return fmt.Errorf("table %q: %d types for %d columns", def.Name, len(def.Types), len(def.Cols))
+	case def.PKeys < 1 || def.PKeys > len(def.Cols):
+		return fmt.Errorf("table %q: the primary key must be 1 to %d columns, not %d", def.Name, len(def.Cols), def.PKeys)
+	}
+	seen := map[string]bool{}
+	for i, col := range def.Cols {
+		if col == "" || seen[col] {
+			return fmt.Errorf("table %q: empty or duplicate column %q", def.Name, col)
+		}
+		seen[col] = true
+		if t := def.Types[i]; t != TypeInt64 && t != TypeBytes && t != TypeString {
+			return fmt.Errorf("table %q: column %q has the unknown type %v", def.Name, col, t)
+		}
+	}
+	return nil
+}
+
+// colIndex returns the position of a column, or -1
+func (def *TableDef) colIndex(col string) int {
+	for i, c := range def.Cols {
+		if c == col {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkValue verifies that val can be stored in the column i
+func (def *TableDef) checkValue(i int, val Value) error {
+	if val.Type != def.Types[i] {
+		return fmt.Errorf("table %q: column %q is %v, not %v", def.Name, def.Cols[i], def.Types[i], val.Type)
+	}
+	if val.Type == TypeString && !utf8.Valid(val.Str) {
+		return fmt.Errorf("table %q: column %q is not valid UTF-8", def.Name, def.Cols[i])
+	}
+	return nil
+}
+
+// values returns the values of the first n columns of rec, in the order of the table.
+// rec must hold exactly these columns.
+func (def *TableDef) values(rec Record, n int) ([]Value, error) {
+	if len(rec.Cols) != len(rec.Vals) {
+		return nil, fmt.Errorf("table %q: the record has %d columns for %d values", def.Name, len(rec.Cols), len(rec.Vals))
+	}
+	vals := make([]Value, n)
+	set := make([]bool, n)
+	for j, col := range rec.Cols {
+		i := def.colIndex(col)
+		if i < 0 || i >= n {
+			return nil, fmt.Errorf("table %q: unexpected column %q", def.Name, col)
+		}
+		if set[i] {
+			return nil, fmt.Errorf("table %q: duplicate column %q", def.Name, col)
+		}
+		if err := def.checkValue(i, rec.Vals[j]); err != nil {
+			return nil, err
+		}
+		vals[i], set[i] = rec.Vals[j], true
+	}
+	for i := range set {
+		if !set[i] {
+			return nil, fmt.Errorf("table %q: missing column %q", def.Name, def.Cols[i])
+		}
+	}
+	return vals, nil
+}
+
+// row returns the values of a full record, in the order of the table
+func (def *TableDef) row(rec Record) ([]Value, error) {
+	return def.values(rec, len(def.Cols))
+}
+
+// primaryKey returns the values of a record holding the primary key only
+func (def *TableDef) primaryKey(rec Record) ([]Value, error) {
+	return def.values(rec, def.PKeys)
+}
@@ -0,0 +1,200 @@
+package table
+
+import (
+	"path/filepath"
+	"testing"
+	"trees/pkg/btree/kvstore"
+
+	"github.com/stretchr/testify/require"
+)
+
+var usersDef = TableDef{
+	Name:  "users",
+	Types: []Type{TypeString, TypeInt64, TypeString, TypeBytes, TypeInt64},
+	Cols:  []string{"org", "id", "name", "avatar", "age"},
+	PKeys: 2,
+}
+
+func user(org string, id int64, name string, age int64) Record {
+	rec := Record{}
+	rec.AddString("org", org).AddInt64("id", id).AddString("name", name).AddBytes("avatar", []byte{0, 1, 2}).AddInt64("age", age)
+	return rec
+}
+
+// getUser reads a user, and returns its name and age
+func getUser(t *testing.T, db *DB, org string, id int64) (string, int64, bool) {
+	t.Helper()
+	rec := Record{}
+	rec.AddInt64("id", id).AddString("org", org)
+	ok, err := db.Get("users", &rec)
+	require.NoError(t, err)
+	if !ok {
+		return "", 0, false
+	}
+	require.Equal(t, usersDef.Cols, rec.Cols)
+	require.Equal(t, []byte{0, 1, 2}, rec.Get("avatar").Str)
+	return string(rec.Get("name").Str), rec.Get("age").I64, true
+}
+
+func openDB(t *testing.T, path string) *DB {
+	t.Helper()
+	kv, err := kvstore.Open(path, kvstore.Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { kv.Close() })
+	return New(kv)
+}
+
+func TestTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openDB(t, path)
+	require.NoError(t, db.CreateTable(usersDef))
+	require.ErrorContains(t, db.CreateTable(usersDef), "already exists")
+
+	added, err := db.Insert("users", user("acme", 1, "alice", 30))
+	require.NoError(t, err)
+	require.True(t, added)
+	added, err = db.Insert("users", user("acme", 1, "bob", 40))
+	require.NoError(t, err)
+	require.False(t, added, "the primary key exists")
+	name, age, ok := getUser(t, db, "acme", 1)
+	require.True(t, ok)
+	require.Equal(t, "alice", name)
+	require.Equal(t, int64(30), age)
+
+	updated, err := db.Update("users", user("acme", 1, "alice", 31))
+	require.NoError(t, err)
+	require.True(t, updated)
+	updated, err = db.Update("users", user("acme", 2, "bob", 40))
+	require.NoError(t, err)
+	require.False(t, updated, "the primary key doesn't exist")
+	_, _, ok = getUser(t, db, "acme", 2)
+	require.False(t, ok)
+
+	added, err = db.Upsert("users", user("acme", 2, "bob", 40))
+	require.NoError(t, err)
+	require.True(t, added)
+	added, err = db.Upsert("users", user("acme", 2, "bob", 41))
+	require.NoError(t, err)
+	require.False(t, added)
+	// the same id in another org
+	added, err = db.Insert("users", user("initech", 1, "carol", 50))
+	require.NoError(t, err)
+	require.True(t, added)
+
+	deleted, err := db.Delete("users", *(&Record{}).AddString("org", "acme").AddInt64("id", 2))
+	require.NoError(t, err)
+	require.True(t, deleted)
+	deleted, err = db.Delete("users", *(&Record{}).AddString("org", "acme").AddInt64("id", 2))
+	require.NoError(t, err)
+	require.False(t, deleted)
+
+	// the catalog and the records are in the file
+	require.NoError(t, db.kv.Close())
+	db = openDB(t, path)
+	name, age, ok = getUser(t, db, "acme", 1)
+	require.True(t, ok)
+	require.Equal(t, "alice", name)
+	require.Equal(t, int64(31), age)
+	name, _, ok = getUser(t, db, "initech", 1)
+	require.True(t, ok)
+	require.Equal(t, "carol", name)
+	_, _, ok = getUser(t, db, "acme", 2)
+	require.False(t, ok)
+
+	// the tables get their own prefixes
+	require.NoError(t, db.CreateTable(TableDef{Name: "other", Types: []Type{TypeInt64}, Cols: []string{"id"}, PKeys: 1}))
+	users, err := db.table(db.kv.Get, "users")
+	require.NoError(t, err)
+	other, err := db.table(db.kv.Get, "other")
+	require.NoError(t, err)
+	require.Equal(t, uint32(TABLE_PREFIX_MIN), users.Prefix)
+	require.Equal(t, uint32(TABLE_PREFIX_MIN+1), other.Prefix)
+	added, err = db.Insert("other", *(&Record{}).AddInt64("id", 1))
+	require.NoError(t, err)
+	require.True(t, added)
+}
+
+func TestTx(t *testing.T) {
+	db := openDB(t, filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, db.CreateTable(usersDef))
+
+	tx := db.Begin()
+	for i := int64(0); i < 10; i++ {
+		added, err := tx.Insert("users", user("acme", i, "user", i))
+		require.NoError(t, err)
+		require.True(t, added)
+	}
+	rec := Record{}
+	rec.AddString("org", "acme").AddInt64("id", 5)
+	ok, err := tx.Get("users", &rec)
+	require.NoError(t, err)
+	require.True(t, ok, "the updates of the transaction")
+	tx.Abort()
+	_, _, ok = getUser(t, db, "acme", 5)
+	require.False(t, ok)
+
+	tx = db.Begin()
+	_, err = tx.Insert("users", user("acme", 5, "user", 5))
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+	_, _, ok = getUser(t, db, "acme", 5)
+	require.True(t, ok)
+}
+
+func TestErrors(t *testing.T) {
+	db := openDB(t, filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, db.CreateTable(usersDef))
+
+	t.Run("definitions", func(t *testing.T) {
+		for _, tc := range []struct {
+			def TableDef
+			err string
+		}{
+			{TableDef{Types: []Type{TypeInt64}, Cols: []string{"id"}, PKeys: 1}, "empty"},
+			{TableDef{Name: "@table", Types: []Type{TypeInt64}, Cols: []string{"id"}, PKeys: 1}, "reserved"},
+			{TableDef{Name: "t"}, "no columns"},
+			{TableDef{Name: "t", Types: []Type{TypeInt64}, Cols: []string{"id", "val"}, PKeys: 1}, "1 types for 2 columns"},
+			{TableDef{Name: "t", Types: []Type{TypeInt64}, Cols: []string{"id"}, PKeys: 0}, "primary key"},
+			{TableDef{Name: "t", Types: []Type{TypeInt64, TypeInt64}, Cols: []string{"id", "id"}, PKeys: 1}, "duplicate"},
+			{TableDef{Name: "t", Types: []Type{7}, Cols: []string{"id"}, PKeys: 1}, "unknown type"},
+		} {
+			require.ErrorContains(t, db.CreateTable(tc.def), tc.err)
+		}
+	})
+
+	t.Run("records", func(t *testing.T) {
+		_, err := db.Insert("nope", user("acme", 1, "alice", 30))
+		require.ErrorContains(t, err, "doesn't exist")
+		rec := user("acme", 1, "alice", 30)
+		rec.Vals[1] = String("1")
+		_, err = db.Insert("users", rec)
+		require.ErrorContains(t, err, `column "id" is int64, not string`)
+		rec = user("acme", 1, "alice", 30)
+		rec.Vals[2] = String("\xff")
+		_, err = db.Insert("users", rec)
+		require.ErrorContains(t, err, "UTF-8")
+		_, err = db.Insert("users", *(&Record{}).AddString("org", "acme").AddInt64("id", 1))
+		require.ErrorContains(t, err, "missing column")
+		rec = user("acme", 1, "alice", 30)
+		_, err = db.Upsert("users", *rec.AddInt64("age", 1))
+		require.ErrorContains(t, err, "duplicate column")
+		rec = user("acme", 1, "alice", 30)
+		_, err = db.Update("users", *rec.AddInt64("height", 1))
+		require.ErrorContains(t, err, "unexpected column")
+		// a primary key only
+		_, err = db.Get("users", &rec)
+		require.ErrorContains(t, err, "unexpected column")
+		_, err = db.Delete("users", *(&Record{}).AddString("org", "acme"))
+		require.ErrorContains(t, err, `missing column "id"`)
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		_, err := db.Insert("users", user("acme", 1, "alice", 30))
+		require.NoError(t, err)
+		def, err := db.table(db.kv.Get, "users")
+		require.NoError(t, err)
+		require.NoError(t, db.kv.Set(encodeKey(def.Prefix, []Value{String("acme"), Int64(1)}), []byte{0xff}))
+		_, err = db.Get("users", (&Record{}).AddString("org", "acme").AddInt64("id", 1))
+		require.ErrorContains(t, err, "corrupted")
+	})
+}